@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// ready reports whether the server accepts new traffic, it is false while the server drains on shutdown.
+var ready atomic.Bool
+
+// HealthHandler reports that the process is alive.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// ReadyHandler reports whether the server is ready to receive traffic.
+// It responds with a 503 status while the server drains on shutdown.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// AdminMiddleware protects the admin area and the metrics with HTTP basic auth, any user name is accepted.
+// If no admin password is configured, they are not found.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminPassword == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(config.AdminPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fuse-chat admin", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ChatStats is a snapshot of a chat's state for the admin area.
+type ChatStats struct {
+	Id          string
+	Age         time.Duration
+	Remaining   time.Duration
+	Connections int
+	Members     int
+	Messages    int
+}
+
+// Stats returns a snapshot of the chat's state.
+func (c *Chat) Stats() ChatStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ChatStats{
+		Id:          c.id,
+		Age:         time.Since(c.createTime).Round(time.Second),
+		Remaining:   time.Until(c.endTime).Round(time.Second),
+		Connections: len(c.conns),
+		Members:     len(c.members),
+		Messages:    len(c.messages),
+	}
+}
+
+// AdminHandler renders the list of live chats.
+func AdminHandler(w http.ResponseWriter, r *http.Request) {
+	list := chats.List()
+	stats := make([]ChatStats, 0, len(list))
+	for _, chat := range list {
+		stats = append(stats, chat.Stats())
+	}
+
+	err := AdminView(stats).Render(clientContext(w, r), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// AdminEndChatHandler ends the chat given in the URL and redirects back to the admin area.
+func AdminEndChatHandler(w http.ResponseWriter, r *http.Request) {
+	chat, ok := chats.Get(chi.URLParam(r, "chatId"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	chat.End(EndReasonAdmin)
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/go-chi/chi"
+)
+
+//go:embed static
+var staticFS embed.FS
+
+// Asset is an embedded static file with its precompressed variants.
+type Asset struct {
+	data        []byte
+	gzip        []byte
+	brotli      []byte
+	contentType string
+}
+
+var (
+	// assets holds every static file by its content-hashed name and its plain name, relative to the static directory.
+	assets = make(map[string]*Asset)
+	// hashedNames maps the plain name of a static file to its content-hashed name.
+	hashedNames = make(map[string]string)
+	// assetsModTime is the start time of the server, embedded files have no modification time.
+	assetsModTime = time.Now()
+)
+
+func init() {
+	err := fs.WalkDir(staticFS, "static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		data, err := staticFS.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(p, "static/")
+		asset := &Asset{data: data, contentType: mime.TypeByExtension(path.Ext(name))}
+		if asset.contentType == "" {
+			asset.contentType = http.DetectContentType(data)
+		}
+		if compressible(asset.contentType) {
+			asset.gzip, asset.brotli = compress(data)
+		}
+
+		sum := sha256.Sum256(data)
+		ext := path.Ext(name)
+		hashed := strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:])[:10] + ext
+
+		assets[name] = asset
+		assets[hashed] = asset
+		hashedNames[name] = hashed
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// compressible reports whether files of the content type benefit from compression.
+func compressible(contentType string) bool {
+	for _, prefix := range []string{"text/", "application/javascript", "text/javascript", "image/svg+xml", "application/json"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compress returns the gzip and brotli compressed data.
+func compress(data []byte) ([]byte, []byte) {
+	gz := &bytes.Buffer{}
+	gw, _ := gzip.NewWriterLevel(gz, gzip.BestCompression)
+	gw.Write(data)
+	gw.Close()
+
+	br := &bytes.Buffer{}
+	bw := brotli.NewWriterLevel(br, brotli.BestCompression)
+	bw.Write(data)
+	bw.Close()
+
+	return gz.Bytes(), br.Bytes()
+}
+
+// asset returns the URL of the static file with the given name (relative to the static directory).
+// The URL contains a hash of the content, so it can be cached forever.
+func asset(name string) string {
+	if hashed, ok := hashedNames[name]; ok {
+		return "/static/" + hashed
+	}
+	return "/static/" + name
+}
+
+// AssetHandler serves the embedded static files.
+// Content-hashed names are cached forever, plain names (e.g. referenced from CSS files) only shortly.
+// The brotli or gzip variant is served if the client accepts it.
+func AssetHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "*")
+	asset, ok := assets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if _, plain := hashedNames[name]; plain {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	data := asset.data
+	accept := r.Header.Get("Accept-Encoding")
+	if asset.brotli != nil && acceptsEncoding(accept, "br") {
+		w.Header().Set("Content-Encoding", "br")
+		data = asset.brotli
+	} else if asset.gzip != nil && acceptsEncoding(accept, "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		data = asset.gzip
+	}
+
+	http.ServeContent(w, r, name, assetsModTime, bytes.NewReader(data))
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header value contains the encoding.
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(name) == encoding && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxUploadSize is the maximum size of a single uploaded file.
+	MaxUploadSize int64 = 5 << 20
+)
+
+// allowedUploadTypes lists the content types that may be uploaded.
+// The type is sniffed from the file content, the type sent by the browser is ignored.
+var allowedUploadTypes = map[string]bool{
+	"image/png":                 true,
+	"image/jpeg":                true,
+	"image/gif":                 true,
+	"image/webp":                true,
+	"text/plain; charset=utf-8": true,
+	"application/pdf":           true,
+}
+
+var (
+	ErrUploadTooLarge  = fmt.Errorf("file is larger than %d MB", MaxUploadSize>>20)
+	ErrUploadForbidden = errors.New("file type is not allowed")
+)
+
+type Attachment struct {
+	id          string
+	name        string
+	contentType string
+	size        int
+}
+
+// URL returns the path the attachment can be downloaded from.
+func (a *Attachment) URL(chat *Chat) string {
+	return fmt.Sprintf("/c/%s/files/%s", chat.id, a.id)
+}
+
+// IsImage reports whether the attachment can be shown as a thumbnail.
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.contentType, "image/")
+}
+
+// Size returns the human readable size of the attachment.
+func (a *Attachment) Size() string {
+	if a.size < 1024 {
+		return fmt.Sprintf("%d B", a.size)
+	}
+	if a.size < 1024*1024 {
+		return fmt.Sprintf("%.1f KB", float64(a.size)/1024)
+	}
+	return fmt.Sprintf("%.1f MB", float64(a.size)/(1024*1024))
+}
+
+// storeAttachment validates the uploaded file and stores it in the blob store of the given chat.
+func storeAttachment(chat *Chat, file multipart.File, header *multipart.FileHeader) (*Attachment, error) {
+	if header.Size > MaxUploadSize {
+		return nil, ErrUploadTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, MaxUploadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > MaxUploadSize {
+		return nil, ErrUploadTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	if !allowedUploadTypes[contentType] {
+		return nil, ErrUploadForbidden
+	}
+
+	attachment := &Attachment{
+		id:          uuid.New().String(),
+		name:        filepath.Base(header.Filename),
+		contentType: contentType,
+		size:        len(data),
+	}
+
+	if err := blobs.Put(chat.id, attachment.id, data); err != nil {
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+// FileHandler serves an attachment of the chat from the blob store.
+// Images are shown inline, every other file is sent as a download.
+func FileHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+
+	attachment := chat.Attachment(chi.URLParam(r, "fileId"))
+	if attachment == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := blobs.Get(chat.id, attachment.id)
+	if errors.Is(err, ErrBlobNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	disposition := "attachment"
+	if attachment.IsImage() {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", attachment.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(data)
+}
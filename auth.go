@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// authCookieName is the cookie keeping the state of a login in progress.
+	authCookieName string = "fuse_chat_auth"
+)
+
+var (
+	ErrLoginFailed     = errors.New("The login failed, please try again.")
+	ErrLoginNotAllowed = errors.New("Your account is not allowed to use this chat server.")
+)
+
+// auth is the OIDC login, nil if clients are anonymous.
+var auth *OIDCAuth
+
+// OIDCAuth logs clients in with an OpenID Connect identity provider.
+type OIDCAuth struct {
+	config   OIDCConfig
+	verifier *oidc.IDTokenVerifier
+	oauth2   oauth2.Config
+}
+
+// authState is kept in the auth cookie between the redirect to the identity provider and the callback.
+type authState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+}
+
+// idClaims are the claims of the ID token used for the client.
+type idClaims struct {
+	Subject           string `json:"sub"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+	EmailVerified     *bool  `json:"email_verified"`
+}
+
+// NewOIDCAuth discovers the identity provider of the configuration.
+func NewOIDCAuth(ctx context.Context, c OIDCConfig) (*OIDCAuth, error) {
+	provider, err := oidc.NewProvider(ctx, c.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCAuth{
+		config:   c,
+		verifier: provider.Verifier(&oidc.Config{ClientID: c.ClientID}),
+		oauth2: oauth2.Config{
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  c.RedirectURL,
+			Scopes:       append([]string{oidc.ScopeOpenID}, c.Scopes...),
+		},
+	}, nil
+}
+
+// allowed reports whether the identity may use the server:
+// its verified email address is in one of the allowed domains or it is a member of one of the allowed groups.
+// Email addresses without an email_verified claim are not trusted.
+// Without allowed domains and groups every identity is allowed.
+func (a *OIDCAuth) allowed(claims idClaims, groups []string) bool {
+	if len(a.config.AllowedDomains) == 0 && len(a.config.AllowedGroups) == 0 {
+		return true
+	}
+
+	if _, domain, ok := strings.Cut(claims.Email, "@"); ok && claims.EmailVerified != nil && *claims.EmailVerified {
+		for _, allowed := range a.config.AllowedDomains {
+			if strings.EqualFold(domain, allowed) {
+				return true
+			}
+		}
+	}
+
+	for _, group := range groups {
+		if slices.Contains(a.config.AllowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// groups returns the groups listed in the configured claim of the ID token.
+func (a *OIDCAuth) groups(token *oidc.IDToken) []string {
+	all := make(map[string]any)
+	if err := token.Claims(&all); err != nil {
+		return nil
+	}
+
+	list, _ := all[a.config.GroupsClaim].([]any)
+	groups := make([]string, 0, len(list))
+	for _, group := range list {
+		if name, ok := group.(string); ok {
+			groups = append(groups, name)
+		}
+	}
+	return groups
+}
+
+// randomString returns a random URL-safe string, used for the state, nonce and similar values.
+func randomString() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// LoginHandler redirects to the identity provider.
+// The "return" query value is the page the client returns to after logging in.
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s := authState{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: oauth2.GenerateVerifier(),
+		Return:   localPath(r.URL.Query().Get("return"), "/"),
+	}
+	data, _ := json.Marshal(s)
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    signCookie(data),
+		Path:     "/auth",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, auth.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(s.Verifier)), http.StatusFound)
+}
+
+// CallbackHandler completes the login: it verifies the ID token returned by the identity provider,
+// checks whether the identity is allowed and stores it in the client cookie.
+// The client keeps its profile, but its ID and name are taken from the identity.
+func CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := parseAuthState(r)
+	http.SetCookie(w, &http.Cookie{Name: authCookieName, Path: "/auth", MaxAge: -1})
+	if err != nil || r.URL.Query().Get("state") != s.State || r.URL.Query().Get("code") == "" {
+		slog.Warn("login failed", slog.Any("error", err), slog.String("provider_error", r.URL.Query().Get("error")))
+		renderDenied(w, r, http.StatusBadRequest, ErrLoginFailed)
+		return
+	}
+
+	token, err := auth.oauth2.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(s.Verifier))
+	if err != nil {
+		slog.Warn("login failed", slog.Any("error", err))
+		renderDenied(w, r, http.StatusBadGateway, ErrLoginFailed)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		slog.Warn("login failed", slog.String("error", "no ID token"))
+		renderDenied(w, r, http.StatusBadGateway, ErrLoginFailed)
+		return
+	}
+	idToken, err := auth.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != s.Nonce {
+		slog.Warn("login failed", slog.Any("error", err))
+		renderDenied(w, r, http.StatusBadRequest, ErrLoginFailed)
+		return
+	}
+
+	var claims idClaims
+	if err := idToken.Claims(&claims); err != nil {
+		renderDenied(w, r, http.StatusBadGateway, ErrLoginFailed)
+		return
+	}
+	if !auth.allowed(claims, auth.groups(idToken)) {
+		slog.Info("login not allowed", slog.String("subject", claims.Subject))
+		renderDenied(w, r, http.StatusForbidden, ErrLoginNotAllowed)
+		return
+	}
+
+	client, err := parseClientCookie(r)
+	if err != nil {
+		client = &Client{}
+	}
+	// The same identity always gets the same client ID.
+	client.Id = uuid.NewSHA1(uuid.NameSpaceURL, []byte(idToken.Issuer+"#"+idToken.Subject)).String()
+	client.Name = firstNonEmpty(claims.Name, claims.PreferredUsername, claims.Email, claims.Subject)
+	client.Email = claims.Email
+	client.Verified = true
+	client.LoggedIn = time.Now().Unix()
+
+	setClientCookie(w, client)
+	slog.Info("client logged in", clientAttr(client))
+	http.Redirect(w, r, s.Return, http.StatusSeeOther)
+}
+
+// LogoutHandler deletes the client cookie, the client continues anonymously.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: cookieName, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// parseAuthState parses the auth cookie of the login in progress.
+func parseAuthState(r *http.Request) (authState, error) {
+	var s authState
+
+	cookie, err := r.Cookie(authCookieName)
+	if err != nil {
+		return s, err
+	}
+	data, err := verifyCookie(cookie.Value)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+// firstNonEmpty returns the first of the values that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// loggedIn reports whether the client logged in with OIDC within the configured session max age.
+func (a *OIDCAuth) loggedIn(client *Client) bool {
+	return client.Verified && time.Since(time.Unix(client.LoggedIn, 0)) < a.config.SessionMaxAge
+}
+
+// LoginRequiredMiddleware only lets logged in clients through if OIDC is enabled.
+// Logins expire after the configured session max age, so changes of the allowed domains and groups take effect.
+// Page requests of anonymous clients are redirected to the login, all other requests get a 401 status.
+func LoginRequiredMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client, err := parseClientCookie(r)
+		if err == nil && auth.loggedIn(client) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodGet && r.Header.Get("HX-Request") != "true" {
+			http.Redirect(w, r, "/auth/login?return="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		http.Error(w, "login required", http.StatusUnauthorized)
+	})
+}
+
+// authEnabled reports whether clients log in with OIDC, used by the templates.
+func authEnabled() bool {
+	return auth != nil
+}
+
+// loginRequired reports whether the client stored in the context has to log in before it may create or join chats.
+func loginRequired(ctx context.Context) bool {
+	client, ok := ctx.Value(ContextClientKey).(*Client)
+	return auth != nil && (!ok || !auth.loggedIn(client))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// mockIdP is an OpenID Connect identity provider for tests. Its token endpoint answers every code
+// with an ID token carrying the claims set by the test, signed with a key published in its JWKS.
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// claims are added to the standard claims of the next ID token.
+	claims map[string]any
+	// nonce is the nonce of the next ID token.
+	nonce string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := idp.server.URL
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/authorize",
+			"token_endpoint":                        issuer + "/token",
+			"jwks_uri":                              issuer + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idToken, err := idp.idToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// idToken returns a signed ID token with the test's claims.
+func (idp *mockIdP) idToken() (string, error) {
+	claims := map[string]any{
+		"iss":   idp.server.URL,
+		"aud":   "fuse-chat",
+		"sub":   "ada",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": idp.nonce,
+	}
+	for name, value := range idp.claims {
+		claims[name] = value
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// setupMockAuth enables the OIDC login against a new mockIdP with the given allowed domains and groups.
+func setupMockAuth(t *testing.T, domains, groups []string) *mockIdP {
+	t.Helper()
+
+	idp := newMockIdP(t)
+	c := DefaultConfig().OIDC
+	c.Issuer = idp.server.URL
+	c.ClientID = "fuse-chat"
+	c.RedirectURL = "http://localhost/auth/callback"
+	c.AllowedDomains = domains
+	c.AllowedGroups = groups
+
+	a, err := NewOIDCAuth(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth = a
+	t.Cleanup(func() { auth = nil })
+
+	if err := setupCookieSecret("test"); err != nil {
+		t.Fatal(err)
+	}
+	return idp
+}
+
+// login starts a login and returns the auth cookie with the state and nonce sent to the identity provider.
+func login(t *testing.T) (*http.Cookie, string, string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	LoginHandler(w, httptest.NewRequest(http.MethodGet, "/auth/login?return=/my", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status %d, want %d", w.Code, http.StatusFound)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != authCookieName {
+		t.Fatalf("login: cookies %v, want the auth cookie", cookies)
+	}
+	return cookies[0], location.Query().Get("state"), location.Query().Get("nonce")
+}
+
+// callback completes the login with the given state and returns the response.
+func callback(cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/auth/callback?code=code&state="+url.QueryEscape(state), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	CallbackHandler(w, r)
+	return w
+}
+
+// loggedInClient returns the client of the client cookie set by the response, nil if there is none.
+func loggedInClient(t *testing.T, w *httptest.ResponseRecorder) *Client {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == cookieName {
+			r.AddCookie(cookie)
+		}
+	}
+	client, err := parseClientCookie(r)
+	if err != nil {
+		return nil
+	}
+	return client
+}
+
+func TestCallbackChecksStateAndNonce(t *testing.T) {
+	idp := setupMockAuth(t, nil, nil)
+
+	cookie, state, nonce := login(t)
+	idp.nonce = nonce
+	if w := callback(cookie, state+"x"); w.Code != http.StatusBadRequest {
+		t.Errorf("wrong state: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	cookie, state, _ = login(t)
+	idp.nonce = "other"
+	if w := callback(cookie, state); w.Code != http.StatusBadRequest {
+		t.Errorf("wrong nonce: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	cookie, state, nonce = login(t)
+	idp.nonce = nonce
+	w := callback(cookie, state)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/my" {
+		t.Fatalf("valid login: status %d to %q, want %d to /my", w.Code, w.Header().Get("Location"), http.StatusSeeOther)
+	}
+	if client := loggedInClient(t, w); client == nil || !client.Verified || !auth.loggedIn(client) {
+		t.Errorf("valid login: client %+v is not logged in", client)
+	}
+}
+
+func TestCallbackAllowList(t *testing.T) {
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		allowed bool
+	}{
+		{"verified email of allowed domain", map[string]any{"email": "ada@example.com", "email_verified": true}, true},
+		{"allowed domain ignores case", map[string]any{"email": "ada@EXAMPLE.com", "email_verified": true}, true},
+		{"unverified email", map[string]any{"email": "ada@example.com", "email_verified": false}, false},
+		{"email without email_verified claim", map[string]any{"email": "ada@example.com"}, false},
+		{"other domain", map[string]any{"email": "ada@example.org", "email_verified": true}, false},
+		{"subdomain", map[string]any{"email": "ada@evil.example.com", "email_verified": true}, false},
+		{"allowed group", map[string]any{"groups": []string{"staff", "chat"}}, true},
+		{"other group", map[string]any{"groups": []string{"staff"}}, false},
+		{"no email and no groups", map[string]any{}, false},
+	}
+
+	idp := setupMockAuth(t, []string{"example.com"}, []string{"chat"})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cookie, state, nonce := login(t)
+			idp.nonce = nonce
+			idp.claims = test.claims
+
+			w := callback(cookie, state)
+			client := loggedInClient(t, w)
+			if test.allowed && (w.Code != http.StatusSeeOther || client == nil || !client.Verified) {
+				t.Errorf("status %d, client %+v: want a logged in client", w.Code, client)
+			}
+			if !test.allowed && (w.Code != http.StatusForbidden || client != nil) {
+				t.Errorf("status %d, client %+v: want %d and no client", w.Code, client, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestLoginRequiredMiddleware(t *testing.T) {
+	setupMockAuth(t, nil, nil)
+	id := uuid.New().String()
+	handler := LoginRequiredMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		client *Client
+		want   int
+	}{
+		{"anonymous", &Client{Id: id}, http.StatusFound},
+		{"logged in", &Client{Id: id, Verified: true, LoggedIn: time.Now().Unix()}, http.StatusOK},
+		{"expired login", &Client{Id: id, Verified: true, LoggedIn: time.Now().Add(-13 * time.Hour).Unix()}, http.StatusFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cookies := httptest.NewRecorder()
+			setClientCookie(cookies, test.client)
+
+			r := httptest.NewRequest(http.MethodGet, "/c/chat", nil)
+			for _, cookie := range cookies.Result().Cookies() {
+				r.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("status %d, want %d", w.Code, test.want)
+			}
+			if w.Code == http.StatusFound && !strings.HasPrefix(w.Header().Get("Location"), "/auth/login?return=") {
+				t.Errorf("redirected to %q, want the login", w.Header().Get("Location"))
+			}
+		})
+	}
+}
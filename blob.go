@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ErrBlobNotFound is returned by a BlobStore if the requested blob does not exist.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores the files shared in a chat.
+// Blobs are grouped by chat, so all files of a chat can be deleted at once when its fuse burns out.
+type BlobStore interface {
+	// Put stores the data under the given chat and blob ID.
+	Put(chatId, blobId string, data []byte) error
+	// Get returns the data stored under the given chat and blob ID.
+	Get(chatId, blobId string) ([]byte, error)
+	// Delete deletes the blob stored under the given chat and blob ID.
+	Delete(chatId, blobId string) error
+	// DeleteChat deletes all blobs stored for the given chat.
+	DeleteChat(chatId string) error
+}
+
+// blobs is the store used for all uploaded files.
+var blobs BlobStore = NewMemoryBlobStore()
+
+// MemoryBlobStore is a BlobStore that keeps all blobs in memory.
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	chats map[string]map[string][]byte
+}
+
+// NewMemoryBlobStore creates an empty MemoryBlobStore.
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{chats: make(map[string]map[string][]byte)}
+}
+
+func (s *MemoryBlobStore) Put(chatId, blobId string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chats[chatId] == nil {
+		s.chats[chatId] = make(map[string][]byte)
+	}
+	s.chats[chatId][blobId] = data
+	return nil
+}
+
+func (s *MemoryBlobStore) Get(chatId, blobId string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := s.chats[chatId][blobId]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return data, nil
+}
+
+func (s *MemoryBlobStore) Delete(chatId, blobId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.chats[chatId], blobId)
+	return nil
+}
+
+func (s *MemoryBlobStore) DeleteChat(chatId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.chats, chatId)
+	return nil
+}
+
+// DirBlobStore is a BlobStore that keeps blobs as files in a local directory.
+// Each chat gets its own subdirectory.
+type DirBlobStore struct {
+	dir string
+}
+
+// NewDirBlobStore creates a DirBlobStore in the given directory, creating the directory if needed.
+// Chats do not survive a restart, so the files of chats left over from a previous run are deleted.
+// Only the chats' subdirectories are deleted, anything else in the directory is left alone.
+func NewDirBlobStore(dir string) (*DirBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if _, err := uuid.Parse(entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return nil, err
+		}
+		slog.Info("deleted files of a previous run", slog.String("chat_id", entry.Name()))
+	}
+	return &DirBlobStore{dir: dir}, nil
+}
+
+// path returns the file path for the given chat and blob ID.
+// IDs are always generated UUIDs, filepath.Base guards against path traversal anyway.
+func (s *DirBlobStore) path(chatId string, blobId ...string) string {
+	elem := []string{s.dir, filepath.Base(chatId)}
+	for _, id := range blobId {
+		elem = append(elem, filepath.Base(id))
+	}
+	return filepath.Join(elem...)
+}
+
+func (s *DirBlobStore) Put(chatId, blobId string, data []byte) error {
+	if err := os.MkdirAll(s.path(chatId), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(chatId, blobId), data, 0o600)
+}
+
+func (s *DirBlobStore) Get(chatId, blobId string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(chatId, blobId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (s *DirBlobStore) Delete(chatId, blobId string) error {
+	err := os.Remove(s.path(chatId, blobId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *DirBlobStore) DeleteChat(chatId string) error {
+	return os.RemoveAll(s.path(chatId))
+}
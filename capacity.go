@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerFull is returned if a server-wide limit is reached and nothing could be evicted to make room.
+var ErrServerFull = errors.New("The server is at capacity, please try again later.")
+
+// usage tracks the resources used by all chats together, checked against config.Limits.
+var usage struct {
+	connections atomic.Int64
+	messages    atomic.Int64
+	bytes       atomic.Int64
+}
+
+// size returns the number of bytes the message retains: its text and attachment.
+func (m *Message) size() int64 {
+	size := int64(len(m.text))
+	if m.attachment != nil {
+		size += int64(m.attachment.size)
+	}
+	return size
+}
+
+// reserveChat makes sure there is room for another chat, evicting an idle chat if configured.
+// The limit is checked before the chat is created, so it is exceeded at most by concurrently created chats.
+func reserveChat() error {
+	if config.Limits.Chats == 0 || chats.Len() < config.Limits.Chats {
+		return nil
+	}
+	if config.Limits.EvictIdle && evictIdleChat(nil) {
+		return nil
+	}
+	return ErrServerFull
+}
+
+// reserveConnection counts a new connection, unless all connections are taken.
+// Every successful reservation must be released with releaseConnection.
+func reserveConnection() error {
+	if n := usage.connections.Add(1); config.Limits.Connections > 0 && n > int64(config.Limits.Connections) {
+		usage.connections.Add(-1)
+		return ErrServerFull
+	}
+	return nil
+}
+
+// releaseConnection releases a connection counted by reserveConnection.
+func releaseConnection() {
+	usage.connections.Add(-1)
+}
+
+// reserveMessage makes sure there is room for another message of the given size in the chat.
+// Idle chats other than the given one are evicted until the message fits, if configured.
+// A message larger than the whole byte limit never fits, so nothing is evicted for it.
+func reserveMessage(chat *Chat, size int64) error {
+	if config.Limits.Bytes > 0 && size > int64(config.Limits.Bytes) {
+		return ErrServerFull
+	}
+	for !messageFits(size) {
+		if !config.Limits.EvictIdle || !evictIdleChat(chat) {
+			return ErrServerFull
+		}
+	}
+	return nil
+}
+
+// messageFits reports whether another message of the given size fits into the limits.
+func messageFits(size int64) bool {
+	if config.Limits.Messages > 0 && usage.messages.Load() >= int64(config.Limits.Messages) {
+		return false
+	}
+	if config.Limits.Bytes > 0 && usage.bytes.Load()+size > int64(config.Limits.Bytes) {
+		return false
+	}
+	return true
+}
+
+// retain counts the message as retained by a chat.
+func retain(m *Message) {
+	usage.messages.Add(1)
+	usage.bytes.Add(m.size())
+}
+
+// release counts the message as no longer retained by a chat.
+func release(m *Message) {
+	usage.messages.Add(-1)
+	usage.bytes.Add(-m.size())
+}
+
+// idleSince returns the time the chat is idle since, and whether it is idle at all.
+// A chat is idle if nobody is connected to it.
+func (c *Chat) idleSince() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.conns) > 0 || c.ended {
+		return time.Time{}, false
+	}
+	if len(c.messages) > 0 {
+		return c.messages[len(c.messages)-1].createdAt, true
+	}
+	return c.createTime, true
+}
+
+// evictIdleChat ends the chat that has been idle the longest, except the given chat.
+// It reports whether a chat was evicted.
+func evictIdleChat(except *Chat) bool {
+	var oldest *Chat
+	var oldestSince time.Time
+	for _, chat := range chats.List() {
+		if chat == except {
+			continue
+		}
+		since, idle := chat.idleSince()
+		if idle && (oldest == nil || since.Before(oldestSince)) {
+			oldest, oldestSince = chat, since
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+	slog.Warn("evicting idle chat", chatAttr(oldest), slog.Duration("idle", time.Since(oldestSince)))
+	oldest.End(EndReasonEvicted)
+	return true
+}
+
+// renderServerFull responds with a 503 status and the ServerFullView.
+func renderServerFull(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "60")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if err := ServerFullView().Render(r.Context(), w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
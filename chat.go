@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -11,31 +14,117 @@ import (
 )
 
 const (
-	ChatDuration time.Duration = time.Duration(1) * time.Minute
+	// connectionBuffer is the number of events buffered per connection before deliveries are dropped.
+	connectionBuffer int = 32
+	// connectionsPerClient is the number of connections (e.g. browser tabs) a chat allows per participant.
+	connectionsPerClient int = 4
 )
 
-var chats = make(map[string]*Chat)
+var chats = NewRegistry()
 
 type Chat struct {
+	mu         sync.Mutex
 	id         string
 	conns      map[string]*Connection
 	createTime time.Time
 	endTime    time.Time
 	duration   time.Duration
-	messages   []Message
+	messages   []*Message
+	ended      bool
+
+	// code is the short invite code of the chat, empty if invite codes are disabled.
+	code string
+	// maxLifetime is the hard cap on the chat's age, the chat ends after it regardless of activity.
+	maxLifetime time.Duration
+	// maxParticipants is the largest number of members, including the owner.
+	maxParticipants int
+	// policy decides how the fuse reacts to new messages.
+	policy FusePolicy
+
+	// owner is the client that created the chat, or the client ownership was transferred to.
+	owner *Client
+	// members holds every client admitted to the chat, keyed by client ID.
+	members map[string]*Client
+	// pending holds the members that joined with an invite but have not connected yet, with the time they joined.
+	pending map[string]time.Time
+	// banned holds the IDs of kicked clients, they may not rejoin.
+	banned map[string]bool
+	// locked chats do not admit new members.
+	locked bool
+	// paused stops the fuse while every member is connected.
+	paused bool
+	// warned holds the warning thresholds the clients have been warned about.
+	warned map[time.Duration]bool
+	// invites holds the outstanding invites minted by the owner, keyed by token.
+	invites map[string]*Invite
+	// posted is the number of messages posted to the chat so far, it numbers the messages.
+	posted int
+	// read holds the number of the last message each member has read, keyed by client ID.
+	read map[string]int
 }
 
 type Connection struct {
 	client  *Client
 	receive chan *Message
+	events  chan *ServerEvent
+	done    chan struct{}
+	closed  bool
+}
+
+// newConnection creates a connection for the given client with buffered event channels.
+func newConnection(client *Client) *Connection {
+	return &Connection{
+		client:  client,
+		receive: make(chan *Message, connectionBuffer),
+		events:  make(chan *ServerEvent, connectionBuffer),
+		done:    make(chan struct{}),
+	}
+}
+
+// close tells the connection's handler to send a final end event and close the stream.
+// It must be called with the chat's lock held.
+func (conn *Connection) close() {
+	if !conn.closed {
+		conn.closed = true
+		close(conn.done)
+	}
+}
+
+// deliver queues the message for the connection without blocking.
+// If the connection does not keep up, the message is dropped.
+func (conn *Connection) deliver(m *Message) {
+	select {
+	case conn.receive <- m:
+	default:
+		droppedDeliveriesCounter.Inc()
+	}
+}
+
+// send queues the server event for the connection without blocking.
+// If the connection does not keep up, the event is dropped.
+func (conn *Connection) send(e *ServerEvent) {
+	select {
+	case conn.events <- e:
+	default:
+		droppedDeliveriesCounter.Inc()
+	}
 }
 
 func (c *Chat) TimeRemaining() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	remaining := time.Until(c.endTime)
+	if c.paused {
+		return fmt.Sprintf("Time left: %s (paused)", remaining.Round(time.Second))
+	}
 	return fmt.Sprintf("Time left: %s", remaining.Round(time.Second))
 }
 
 func (c *Chat) Connections() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	return fmt.Sprintf("Connections: %d", len(c.conns))
 }
 
@@ -44,47 +133,312 @@ func (c *Chat) Age() string {
 	return fmt.Sprintf("Chat age: %s", age.Round(time.Second))
 }
 
+func (c *Chat) MaxAge() string {
+	return fmt.Sprintf("Max age: %s", shortDuration(c.maxLifetime))
+}
+
+// Deadline returns the time the chat ends at the latest, no matter how active it is.
+func (c *Chat) Deadline() time.Time {
+	return c.createTime.Add(c.maxLifetime)
+}
+
+// clampEndTime makes sure the fuse does not burn longer than the chat's deadline.
+// It must be called with the chat's lock held.
+func (c *Chat) clampEndTime() {
+	if deadline := c.Deadline(); c.endTime.After(deadline) {
+		c.endTime = deadline
+	}
+}
+
 func (c *Chat) URL() string {
-	return fmt.Sprintf("%s/c/%s", domain, c.id)
+	return fmt.Sprintf("%s/c/%s", config.BaseURL, c.id)
+}
+
+// AddConnection registers the connection under the given ID, so it receives all new messages.
+// The first connection of a client joins it to the chat's members, taking a seat.
+// Returns the errors of Admit if the client may not join (e.g. it was kicked meanwhile),
+// ErrChatFull if the chat has all the connections its participants may open
+// and ErrServerFull if the server has all the connections it allows.
+func (c *Chat) AddConnection(id string, conn *Connection) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.conns) >= c.maxParticipants*connectionsPerClient {
+		return ErrChatFull
+	}
+	if err := reserveConnection(); err != nil {
+		return err
+	}
+	if err := c.join(conn.client); err != nil {
+		releaseConnection()
+		return err
+	}
+
+	delete(c.pending, conn.client.Id)
+	c.conns[id] = conn
+	activeConnectionsGauge.Inc()
+	slog.Debug("connection opened", chatAttr(c), clientAttr(conn.client), slog.String("connection_id", id))
+	return nil
+}
+
+// RemoveConnection unregisters the connection with the given ID.
+func (c *Chat) RemoveConnection(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if conn, ok := c.conns[id]; ok {
+		delete(c.conns, id)
+		releaseConnection()
+		activeConnectionsGauge.Dec()
+		slog.Info("connection dropped", chatAttr(c), clientAttr(conn.client), slog.String("connection_id", id))
+	}
 }
 
 // ReceiveMessage broadcasts the given message to all connected clients and adds it to the chat's message history.
-// It also resets the chat's fuse by updating the end time.
+// It also resets the chat's fuse by updating the end time as decided by the chat's FusePolicy.
+// Self-destructing messages are scheduled for removal, see Message.burnAfter and Message.burnAfterRead.
+// Messages received after the chat ended are dropped together with their attachment.
 func (c *Chat) ReceiveMessage(m *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ended {
+		if m.attachment != nil {
+			blobs.Delete(c.id, m.attachment.id)
+		}
+		return
+	}
+
+	if m.burnAfterRead {
+		m.unread = make(map[string]bool)
+	}
+	c.broadcast(m)
+	messagesPostedCounter.Inc()
+	slog.Debug("message posted", chatAttr(c), clientAttr(m.client), textAttr(m.text))
+	c.endTime = c.policy.Reset(time.Now(), c.endTime, m.client)
+	c.clampEndTime()
+
+	if m.burnAfter > 0 {
+		time.AfterFunc(m.burnAfter, func() { c.RemoveMessage(m.id) })
+	}
+	if m.burnAfterRead && len(m.unread) == 0 {
+		// Nobody else is around to read it.
+		time.AfterFunc(BurnAfterReadDelay, func() { c.RemoveMessage(m.id) })
+	}
+}
+
+// broadcast delivers the message to all connected clients and adds it to the chat's message history.
+// The members' dashboards are notified of the new message.
+// It must be called with the chat's lock held.
+func (c *Chat) broadcast(m *Message) {
+	c.posted++
+	m.seq = c.posted
 	for _, connection := range c.conns {
-		connection.receive <- m
+		if m.burnAfterRead && connection.client.Id != m.client.Id {
+			m.unread[connection.client.Id] = true
+		}
+		connection.deliver(m)
+	}
+	c.messages = append(c.messages, m)
+	retain(m)
+	c.notifyMembers()
+}
+
+// MessageDelivered records that the message has been delivered over the given connection.
+// The message counts as read by the connection's client, which is added to the clients that have seen the message,
+// and the author's connections are sent the updated read receipt.
+// Once a burn-after-read message has been delivered to every client that was connected when it was sent,
+// it is removed after BurnAfterReadDelay, leaving everyone a moment to actually read it.
+func (c *Chat) MessageDelivered(conn *Connection, m *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client := conn.client
+	if m.seq > c.read[client.Id] {
+		c.read[client.Id] = m.seq
+		dashboards.notify(client.Id)
+	}
+	if m.system {
+		return
+	}
+
+	if client.Id != m.client.Id && m.markSeen(client) {
+		event := &ServerEvent{name: "receipt", data: ReceiptView(m, true)}
+		for _, connection := range c.conns {
+			if connection.client.Id == m.client.Id {
+				connection.send(event)
+			}
+		}
+	}
+
+	if !m.burnAfterRead || !m.unread[client.Id] {
+		return
+	}
+
+	delete(m.unread, client.Id)
+	if len(m.unread) == 0 {
+		time.AfterFunc(BurnAfterReadDelay, func() { c.RemoveMessage(m.id) })
+	}
+}
+
+// RemoveMessage deletes the message with the given ID from the chat's message history,
+// deletes its attachment and tells every connected client to remove the rendered message.
+// Once the chat has ended, its messages are gone already and pending removals do nothing.
+func (c *Chat) RemoveMessage(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ended {
+		return
+	}
+
+	for i, message := range c.messages {
+		if message.id != id {
+			continue
+		}
+
+		c.messages = append(c.messages[:i], c.messages[i+1:]...)
+		release(message)
+		if message.attachment != nil {
+			blobs.Delete(c.id, message.attachment.id)
+		}
+
+		event := &ServerEvent{name: "remove", data: MessageRemovedView(message)}
+		for _, connection := range c.conns {
+			connection.send(event)
+		}
+		c.notifyMembers()
+		return
+	}
+}
+
+// Attachment returns the attachment with the given ID or nil if no message in the chat has it.
+func (c *Chat) Attachment(id string) *Attachment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, message := range c.messages {
+		if message.attachment != nil && message.attachment.id == id {
+			return message.attachment
+		}
+	}
+	return nil
+}
+
+// End ends the chat immediately for the given reason (see EndReasonFuse etc.).
+// It removes the chat from the registry together with all files shared in the chat
+// and closes every connection, which sends the clients to the end page.
+func (c *Chat) End(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ended {
+		return
+	}
+	c.ended = true
+
+	activeChatsGauge.Dec()
+	chatsEndedCounter.WithLabelValues(reason).Inc()
+	chatLifetimeHistogram.Observe(time.Since(c.createTime).Seconds())
+	slog.Info("chat ended", chatAttr(c), slog.String("reason", reason), slog.Duration("age", time.Since(c.createTime)))
+
+	chats.Remove(c.id)
+	c.notifyMembers()
+	blobs.DeleteChat(c.id)
+	for _, message := range c.messages {
+		release(message)
+	}
+	c.messages = nil
+
+	for _, connection := range c.conns {
+		connection.close()
 	}
-	c.messages = append(c.messages, *m)
-	c.endTime = time.Now().Add(c.duration)
 }
 
 // StartFuse starts the "fuse" for the chat.
 // It continuously checks if the time until the chat's end time has elapsed.
-// If the end time has elapsed, it deletes the chat from the chats map.
+// If the end time has elapsed, the chat is ended. The loop also stops if the chat was ended otherwise.
+// While the fuse is paused and every member is connected, the end time is pushed back by the time that passed.
+// Clients are warned whenever the remaining time drops below one of the configured warning thresholds.
 func (c *Chat) StartFuse() {
+	lastTick := time.Now()
 	for {
-		if time.Until(c.endTime) <= 0 {
-			delete(chats, c.id)
+		c.mu.Lock()
+		now := time.Now()
+		c.freePendingSeats(now)
+		if c.paused && c.allConnected() {
+			c.endTime = c.endTime.Add(now.Sub(lastTick))
+			c.clampEndTime()
+		}
+		lastTick = now
+		c.sendWarnings(now)
+		burnedOut := time.Until(c.endTime) <= 0
+		ended := c.ended
+		c.mu.Unlock()
+
+		if ended {
+			break
+		}
+		if burnedOut {
+			if now.Before(c.Deadline()) {
+				c.End(EndReasonFuse)
+			} else {
+				c.End(EndReasonLifetime)
+			}
 			break
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
 }
 
-// NewChat creates a new Chat instance with the given duration.
+// ChatOptions holds the settings chosen when creating a chat.
+type ChatOptions struct {
+	// Duration is the length of the fuse.
+	Duration time.Duration
+	// MaxLifetime is the hard cap on the chat's age.
+	MaxLifetime time.Duration
+	// Policy decides how the fuse reacts to new messages, defaults to resetting the fuse to its full duration.
+	Policy FusePolicy
+	// MaxParticipants is the largest number of members, defaults to the server's maximum.
+	MaxParticipants int
+}
+
+// NewChat creates a new Chat instance with the given options, owned by the given client.
 // It generates a unique ID using UUID and initializes the chat's properties.
-// The chat is added to the chats map and its fuse is started in a separate goroutine.
+// The chat is added to the registry and its fuse is started in a separate goroutine.
 // Returns the created Chat instance.
-func NewChat(d time.Duration) *Chat {
+func NewChat(options ChatOptions, owner *Client) *Chat {
+	if options.Policy == nil {
+		options.Policy = &FullResetPolicy{Duration: options.Duration}
+	}
+	if options.MaxParticipants <= 0 {
+		options.MaxParticipants = config.MaxParticipants
+	}
+
 	chat := &Chat{
-		id:         uuid.New().String(),
-		conns:      make(map[string]*Connection),
-		createTime: time.Now(),
-		endTime:    time.Now().Add(d),
-		duration:   d,
-		messages:   make([]Message, 0),
+		id:              uuid.New().String(),
+		conns:           make(map[string]*Connection),
+		createTime:      time.Now(),
+		endTime:         time.Now().Add(options.Duration),
+		duration:        options.Duration,
+		messages:        make([]*Message, 0),
+		maxLifetime:     options.MaxLifetime,
+		maxParticipants: options.MaxParticipants,
+		policy:          options.Policy,
+		owner:           owner,
+		members:         map[string]*Client{owner.Id: owner},
+		pending:         make(map[string]time.Time),
+		banned:          make(map[string]bool),
+		warned:          make(map[time.Duration]bool),
+		invites:         make(map[string]*Invite),
+		read:            make(map[string]int),
 	}
+	chat.clampEndTime()
 
-	chats[chat.id] = chat
+	chats.Add(chat)
+	chats.AddMember(owner.Id, chat)
+	activeChatsGauge.Inc()
+	slog.Info("chat created", chatAttr(chat), clientAttr(owner), slog.Duration("max_lifetime", chat.maxLifetime))
 	go chat.StartFuse()
 	return chat
 }
@@ -100,41 +454,101 @@ const (
 )
 
 // ChatMiddleware is a middleware function that handles request on the /c/ route.
-// It retrieves the chat ID from the URL parameters, checks if the chat exists,
-// creates a new client, and adds the chat and client to the request context.
+// It retrieves the chat ID or invite code from the URL parameters, checks if the chat exists,
+// creates a new client, admits the client to the chat and adds the chat and client to the request context.
+// Kicked clients and new clients of a locked or full chat are denied access.
+// Only members may make requests other than GET, clients join by connecting to the chat's stream.
 // The next handler is then called with the updated request context.
 func ChatMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		paramId := chi.URLParam(r, "chatId")
-		chat, ok := chats[paramId]
+		ip := remoteIP(r)
+		limited := lookupLimiter.Limited(ip)
+		chat, ok := lookupChat(paramId, ip)
 		if !ok {
+			if limited {
+				http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+				return
+			}
 			http.NotFound(w, r)
 			return
 		}
 
 		// get or create new client
 		client := newClient(w, r, chat)
+		ctx := context.WithValue(r.Context(), ContextClientKey, client)
 
-		// add chat and client to handler context
-		ctx := context.WithValue(r.Context(), ContextChatKey, chat)
-		ctx = context.WithValue(ctx, ContextClientKey, client)
+		if err := chat.Admit(client); err != nil {
+			renderDenied(w, r.WithContext(ctx), http.StatusForbidden, err)
+			return
+		}
+		if r.Method != http.MethodGet && !chat.IsMember(client) {
+			http.Error(w, ErrNotMember.Error(), http.StatusForbidden)
+			return
+		}
+
+		// add chat to handler context
+		ctx = context.WithValue(ctx, ContextChatKey, chat)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// IndexHandler renders the IndexView.
+// The client cookie is created here already, so the form creating a chat can carry the CSRF token.
+func IndexHandler(w http.ResponseWriter, r *http.Request) {
+	err := IndexView().Render(clientContext(w, r), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // NewChatHandler is a handler function that creates a new chat and redirects the user to the chat page.
+// The requesting client becomes the owner of the chat.
+// The "lifetime" form value selects the chat's maximum lifetime, bounded by the server's maximum lifetime,
+// the "participants" form value the chat's maximum number of participants, bounded by the server's maximum,
+// the "fuse" form value selects the chat's FusePolicy.
+// Chat creation is rate limited per IP address and refused with a 503 status if the server is at capacity.
 func NewChatHandler(w http.ResponseWriter, r *http.Request) {
-	chat := NewChat(ChatDuration)
+	if !chatLimiter.Allow(remoteIP(r)) {
+		http.Error(w, "too many chats created, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	if err := reserveChat(); err != nil {
+		renderServerFull(w, r)
+		return
+	}
+
+	lifetime, err := time.ParseDuration(r.FormValue("lifetime"))
+	if err != nil || lifetime <= 0 || lifetime > config.Fuse.MaxLifetime {
+		lifetime = config.Fuse.MaxLifetime
+	}
+
+	participants, err := strconv.Atoi(r.FormValue("participants"))
+	if err != nil || participants < 2 || participants > config.MaxParticipants {
+		participants = config.MaxParticipants
+	}
+
+	client := newClient(w, r, nil)
+	chat := NewChat(ChatOptions{
+		Duration:        config.Fuse.Duration,
+		MaxLifetime:     lifetime,
+		MaxParticipants: participants,
+		Policy:          NewFusePolicy(r.FormValue("fuse"), config.Fuse.Duration),
+	}, client)
 	http.Redirect(w, r, "/c/"+chat.id, http.StatusFound)
 }
 
 // ChatHandler handles the HTTP request for the chat functionality.
 // It retrieves the chat from the request context and renders the ChatView template.
+// Opening the chat marks all of its messages as read, the page only shows messages posted from now on.
 // If there is an error during rendering, it returns an internal server error.
 func ChatHandler(w http.ResponseWriter, r *http.Request) {
 	chat := r.Context().Value(ContextChatKey).(*Chat)
 	client := r.Context().Value(ContextClientKey).(*Client)
 
+	chat.MarkRead(client)
+
 	err := ChatView(chat, client).Render(r.Context(), w)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -142,8 +556,27 @@ func ChatHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // EndChatHandler is a HTTP handler function that renders the ChatEndView template.
+// Requests made by htmx (e.g. triggered by the end event) are redirected to the end page instead.
 func EndChatHandler(w http.ResponseWriter, r *http.Request) {
-	err := ChatEndView().Render(r.Context(), w)
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", "/end")
+		return
+	}
+
+	err := ChatEndView().Render(clientContext(w, r), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ChatFullHandler renders the ChatFullView, htmx requests of the full event are redirected to it.
+func ChatFullHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", "/full")
+		return
+	}
+
+	err := ChatFullView().Render(clientContext(w, r), w)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -153,17 +586,18 @@ func EndChatHandler(w http.ResponseWriter, r *http.Request) {
 // It takes the chat ID from the URL parameter and checks if the chat exists.
 // If the chat does not exist, it sets the "HX-Redirect" header to "/end" and returns a 286 status code (to end htmx polling).
 // If the chat exists, it renders the ChatStatusView using the chat data and writes the response.
-// This handler does not use the chat middleware.
+// This handler does not use the chat middleware, the client is only read from its cookie to show the owner's controls.
 func ChatStatusHandler(w http.ResponseWriter, r *http.Request) {
 	chatId := chi.URLParam(r, "chatId")
-	chat, ok := chats[chatId]
+	chat, ok := chats.Get(chatId)
 	if !ok {
 		w.Header().Add("HX-Redirect", "/end")
 		w.WriteHeader(286)
 		return
 	}
 
-	err := ChatStatusView(chat).Render(r.Context(), w)
+	client, _ := parseClientCookie(r)
+	err := ChatStatusView(chat, client).Render(r.Context(), w)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	petname "github.com/dustinkirkland/golang-petname"
 	"github.com/google/uuid"
@@ -12,14 +19,76 @@ import (
 type Client struct {
 	Id   string `json:"id,string"`
 	Name string `json:"name,string"`
+	// Color and Avatar are the optional profile of the client, see profile.go.
+	Color  string `json:"color,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+	// Email and Verified are set if the client logged in with OIDC, see auth.go.
+	Email    string `json:"email,omitempty"`
+	Verified bool   `json:"verified,omitempty"`
+	// LoggedIn is the unix time of the last OIDC login, the login expires after the configured session max age.
+	LoggedIn int64 `json:"logged_in,omitempty"`
+	// Issued is the unix time the cookie was last issued, used to renew it.
+	Issued int64 `json:"issued,omitempty"`
 }
 
 const (
 	cookieName string = "fuse_chat_cookie"
+	// cookieRenewAfter is the age after which the cookie is issued again, so an identity in use does not expire.
+	cookieRenewAfter time.Duration = 24 * time.Hour
 )
 
+// cookieSecret is the key the client cookies are signed with.
+var cookieSecret []byte
+
+// setupCookieSecret sets the key the client cookies are signed with.
+// If the secret is empty, a random key is generated, so cookies are only valid until the server restarts.
+func setupCookieSecret(secret string) error {
+	if secret != "" {
+		cookieSecret = []byte(secret)
+		return nil
+	}
+
+	slog.Warn("no cookie secret configured, client identities and profiles are lost on every restart")
+	cookieSecret = make([]byte, 32)
+	_, err := rand.Read(cookieSecret)
+	return err
+}
+
+// signCookie returns the cookie value for the data: the base64 encoded data and its signature, separated by a dot.
+func signCookie(data []byte) string {
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write(data)
+	return base64.StdEncoding.EncodeToString(data) + "." + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCookie verifies the signature of the cookie value and returns the data.
+func verifyCookie(value string) ([]byte, error) {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, errors.New("cookie is not signed")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return nil, errors.New("invalid cookie signature")
+	}
+
+	return data, nil
+}
+
 // parseClientCookie parses the client cookie from the given HTTP request.
-// It decodes the cookie value, unmarshals it into a Client struct,
+// It verifies and decodes the cookie value, unmarshals it into a Client struct,
 // and validates the client ID using UUID parsing.
 // If successful, it returns the parsed Client object.
 // Otherwise, it returns an error.
@@ -29,7 +98,7 @@ func parseClientCookie(r *http.Request) (*Client, error) {
 		return nil, err
 	}
 
-	data, err := base64.StdEncoding.DecodeString(cookie.Value)
+	data, err := verifyCookie(cookie.Value)
 	if err != nil {
 		return nil, err
 	}
@@ -55,6 +124,7 @@ func parseClientCookie(r *http.Request) (*Client, error) {
 // If the client cookie exists in the request, it parses the client information from the cookie.
 // If the client cookie does not exist, it generates a new client with a unique ID and a random name.
 // The client information is then stored in a cookie and set in the response.
+// Cookies older than cookieRenewAfter are issued again, so the identity lives as long as it is used.
 // The function returns the created client.
 func newClient(w http.ResponseWriter, r *http.Request, c *Chat) *Client {
 	client, err := parseClientCookie(r)
@@ -64,19 +134,26 @@ func newClient(w http.ResponseWriter, r *http.Request, c *Chat) *Client {
 			Id:   uuid.New().String(),
 			Name: petname.Generate(2, "-"),
 		}
-
-		data, _ := json.Marshal(client)
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     cookieName,
-			Value:    base64.StdEncoding.EncodeToString(data),
-			Path:     "/",
-			MaxAge:   3600,
-			HttpOnly: true,
-			Secure:   true,
-			SameSite: http.SameSiteLaxMode,
-		})
+		setClientCookie(w, client)
+	} else if time.Since(time.Unix(client.Issued, 0)) > cookieRenewAfter {
+		setClientCookie(w, client)
 	}
 
 	return client
 }
+
+// setClientCookie stores the client in the signed client cookie, valid for the configured identity lifetime.
+func setClientCookie(w http.ResponseWriter, client *Client) {
+	client.Issued = time.Now().Unix()
+	data, _ := json.Marshal(client)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    signCookie(data),
+		Path:     "/",
+		MaxAge:   int(config.IdentityMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
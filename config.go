@@ -0,0 +1,574 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the server configuration.
+// It is loaded from (in increasing precedence) the defaults, an optional YAML file,
+// FUSECHAT_* environment variables and command line flags.
+type Config struct {
+	// Listen is the address the server listens on, e.g. ":8080".
+	Listen string `yaml:"listen"`
+	// BaseURL is the public URL of the server including the scheme, used for invite links.
+	// Defaults to http://localhost with the port of Listen.
+	BaseURL string `yaml:"base_url"`
+
+	Fuse      FuseConfig      `yaml:"fuse"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Log       LogConfig       `yaml:"log"`
+	Limits    LimitsConfig    `yaml:"limits"`
+	OIDC      OIDCConfig      `yaml:"oidc"`
+
+	// CookieSecret signs the client cookies. If empty, a random secret is generated on startup,
+	// so client identities and profiles only persist across restarts if it is set.
+	CookieSecret string `yaml:"cookie_secret"`
+	// AdminPassword protects the admin area and the metrics, both are disabled if it is empty.
+	AdminPassword string `yaml:"admin_password"`
+	// Drain is the time the server reports not ready before shutting down.
+	Drain time.Duration `yaml:"drain"`
+	// MaxParticipants is the largest number of participants a chat can be created with.
+	MaxParticipants int `yaml:"max_participants"`
+	// IdentityMaxAge is the time a client keeps its identity and profile without visiting.
+	IdentityMaxAge time.Duration `yaml:"identity_max_age"`
+	// InviteCodes gives every chat a short word-based invite code next to its ID.
+	// The codes are much easier to guess than the chat IDs, so they are off by default.
+	InviteCodes bool `yaml:"invite_codes"`
+	// TrustedProxies are the IP addresses or CIDR ranges of reverse proxies in front of the server.
+	// Requests from them are rate limited by the client address in their X-Forwarded-For or X-Real-IP header.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+type FuseConfig struct {
+	// Duration is the length of a new chat's fuse.
+	Duration time.Duration `yaml:"duration"`
+	// MaxDuration is the maximum time left on a fuse that can be reached by extending it.
+	MaxDuration time.Duration `yaml:"max_duration"`
+	// MaxLifetime is the maximum lifetime of a chat, regardless of activity.
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+	// Warnings are the remaining times at which clients are warned that the fuse is about to burn out.
+	// Thresholds not below a chat's fuse duration are skipped, a full fuse would be below them right away.
+	Warnings []time.Duration `yaml:"warnings"`
+}
+
+type RateLimitConfig struct {
+	// Messages is the number of messages a client may post per second, 0 disables the limit.
+	Messages float64 `yaml:"messages"`
+	// MessageBurst is the number of messages a client may post at once.
+	MessageBurst int `yaml:"message_burst"`
+	// Chats is the number of chats an IP address may create per minute, 0 disables the limit.
+	Chats float64 `yaml:"chats"`
+	// Lookups is the number of failed chat lookups an IP address may make per minute, 0 disables the limit.
+	Lookups float64 `yaml:"lookups"`
+}
+
+// TLSConfig configures serving HTTPS. TLS is enabled by configuring exactly one certificate source:
+// certificate and key files, ACME or a self-signed certificate.
+type TLSConfig struct {
+	// Cert and Key are the paths to the certificate and key files.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ACME obtains certificates automatically, e.g. from Let's Encrypt.
+	ACME ACMEConfig `yaml:"acme"`
+	// SelfSigned serves a generated self-signed certificate, meant for local testing.
+	SelfSigned bool `yaml:"self_signed"`
+	// Redirect is the address of a plain HTTP listener that redirects to HTTPS, e.g. ":80".
+	// With ACME it also answers the HTTP-01 challenges.
+	Redirect string `yaml:"redirect"`
+	// HSTS is the max-age of the Strict-Transport-Security header, 0 disables the header.
+	// It is never sent with a self-signed certificate, which would pin HTTPS for localhost in the browser.
+	HSTS time.Duration `yaml:"hsts"`
+}
+
+type ACMEConfig struct {
+	// Domains are the host names certificates are requested for, ACME is disabled if it is empty.
+	Domains []string `yaml:"domains"`
+	// CacheDir is the directory the certificates and account key are cached in.
+	CacheDir string `yaml:"cache_dir"`
+	// Email is the contact address of the ACME account.
+	Email string `yaml:"email"`
+	// DirectoryURL is the ACME directory, defaults to Let's Encrypt.
+	// Point it to a local test CA (e.g. pebble) for testing.
+	DirectoryURL string `yaml:"directory_url"`
+}
+
+// Enabled reports whether the server is served over HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.Cert != "" || len(c.ACME.Domains) > 0 || c.SelfSigned
+}
+
+type StorageConfig struct {
+	// Backend is the blob store for shared files: "memory" or "dir".
+	Backend string `yaml:"backend"`
+	// Dir is the directory of the "dir" backend. Files of chats left over from a previous run are deleted at startup.
+	Dir string `yaml:"dir"`
+}
+
+// LimitsConfig caps the resources used by all chats together, 0 disables a limit.
+type LimitsConfig struct {
+	// Chats is the maximum number of active chats.
+	Chats int `yaml:"chats"`
+	// Connections is the maximum number of open message streams.
+	Connections int `yaml:"connections"`
+	// Messages is the maximum number of messages retained in all chats.
+	Messages int `yaml:"messages"`
+	// Bytes is the maximum size of the messages and attachments retained in all chats.
+	Bytes int `yaml:"bytes"`
+	// EvictIdle ends the chats that have been idle the longest to make room, instead of refusing new chats and messages.
+	// Only chats nobody is connected to are evicted.
+	EvictIdle bool `yaml:"evict_idle"`
+}
+
+// OIDCConfig configures the optional OpenID Connect login.
+// If it is enabled, only logged in clients may create and join chats, otherwise clients are anonymous.
+type OIDCConfig struct {
+	// Issuer is the URL of the identity provider, OIDC is disabled if it is empty.
+	Issuer string `yaml:"issuer"`
+	// ClientID and ClientSecret are the credentials of the server at the identity provider.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// RedirectURL is the callback URL registered at the identity provider, defaults to the base URL with /auth/callback.
+	RedirectURL string `yaml:"redirect_url"`
+	// Scopes are requested in addition to "openid".
+	Scopes []string `yaml:"scopes"`
+	// AllowedDomains are the email domains allowed to log in.
+	AllowedDomains []string `yaml:"allowed_domains"`
+	// AllowedGroups are the groups allowed to log in, read from the GroupsClaim of the ID token.
+	// If neither domains nor groups are configured, everyone the identity provider authenticates is allowed.
+	AllowedGroups []string `yaml:"allowed_groups"`
+	// GroupsClaim is the name of the ID token claim listing the groups.
+	GroupsClaim string `yaml:"groups_claim"`
+	// SessionMaxAge is the time after which logged in clients have to log in again,
+	// so clients removed from the allowed domains or groups lose access.
+	SessionMaxAge time.Duration `yaml:"session_max_age"`
+}
+
+// Enabled reports whether clients have to log in with OIDC.
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != ""
+}
+
+type LogConfig struct {
+	// Level is the log level: debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Format is the log format: text or json.
+	Format string `yaml:"format"`
+	// Redact replaces message content and client names in the logs.
+	Redact bool `yaml:"redact"`
+}
+
+// config is the configuration of the running server.
+var config = DefaultConfig()
+
+// DefaultConfig returns the configuration used if nothing else is configured.
+func DefaultConfig() Config {
+	return Config{
+		Listen: ":8080",
+		Fuse: FuseConfig{
+			Duration:    time.Minute,
+			MaxDuration: time.Hour,
+			MaxLifetime: 24 * time.Hour,
+			Warnings:    []time.Duration{30 * time.Second, 10 * time.Second},
+		},
+		RateLimit: RateLimitConfig{
+			Messages:     2,
+			MessageBurst: 5,
+			Chats:        10,
+			Lookups:      10,
+		},
+		TLS: TLSConfig{
+			ACME: ACMEConfig{CacheDir: "autocert-cache"},
+			HSTS: 365 * 24 * time.Hour,
+		},
+		Storage: StorageConfig{Backend: "memory"},
+		Log:     LogConfig{Level: "info", Format: "text"},
+		OIDC: OIDCConfig{
+			Scopes:        []string{"profile", "email"},
+			GroupsClaim:   "groups",
+			SessionMaxAge: 12 * time.Hour,
+		},
+		Limits: LimitsConfig{
+			Chats:       1000,
+			Connections: 5000,
+			Messages:    100000,
+			Bytes:       256 << 20,
+		},
+		Drain:           5 * time.Second,
+		MaxParticipants: 20,
+		IdentityMaxAge:  30 * 24 * time.Hour,
+	}
+}
+
+// LoadConfig loads the configuration from the config file, the environment and the given command line arguments.
+// The config file is given by the -c flag or the FUSECHAT_CONFIG environment variable.
+func LoadConfig(args []string) (Config, error) {
+	c := DefaultConfig()
+
+	fs := flag.NewFlagSet("fuse-chat", flag.ContinueOnError)
+	file := fs.String("c", os.Getenv("FUSECHAT_CONFIG"), "Provide a YAML config file")
+	port := fs.Int("p", 8080, "Provide a port number")
+	baseURL := fs.String("d", "", "Provide the public base URL, e.g. https://chat.example.com (default: http://localhost:<port>)")
+	dir := fs.String("f", "", "Provide a directory to store shared files in (default: in memory)")
+	maxLifetime := fs.Duration("l", c.Fuse.MaxLifetime, "Provide the maximum lifetime of a chat, regardless of activity")
+	warnings := fs.String("w", "30s,10s", "Provide a comma separated list of remaining fuse times to warn clients at")
+	logLevel := fs.String("log-level", c.Log.Level, "Provide the log level: debug, info, warn or error")
+	logFormat := fs.String("log-format", c.Log.Format, "Provide the log format: text or json")
+	logRedact := fs.Bool("log-redact", false, "Redact message content and client names in the logs")
+	adminPassword := fs.String("admin-password", "", "Provide a password to enable the admin area at /admin and the metrics at /metrics")
+	drain := fs.Duration("drain", c.Drain, "Provide the time to report not ready before shutting down")
+	maxParticipants := fs.Int("max-participants", c.MaxParticipants, "Provide the maximum number of participants of a chat")
+	tlsCert := fs.String("tls-cert", "", "Provide a TLS certificate file")
+	tlsKey := fs.String("tls-key", "", "Provide a TLS key file")
+	tlsACME := fs.String("tls-acme", "", "Provide a comma separated list of domains to obtain ACME certificates for")
+	tlsSelfSigned := fs.Bool("tls-self-signed", false, "Serve a self-signed certificate for local testing")
+	tlsRedirect := fs.String("tls-redirect", "", "Provide an address to redirect plain HTTP to HTTPS from, e.g. :80")
+
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return c, err
+		}
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return c, fmt.Errorf("config file %s: %w", *file, err)
+		}
+	}
+
+	if err := c.loadEnv(); err != nil {
+		return c, err
+	}
+
+	// Only flags given on the command line override the file and environment.
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			c.Listen = ":" + strconv.Itoa(*port)
+		case "d":
+			c.BaseURL = *baseURL
+		case "f":
+			c.Storage = StorageConfig{Backend: "dir", Dir: *dir}
+		case "l":
+			c.Fuse.MaxLifetime = *maxLifetime
+		case "w":
+			c.Fuse.Warnings, err = parseDurations(*warnings)
+		case "log-level":
+			c.Log.Level = *logLevel
+		case "log-format":
+			c.Log.Format = *logFormat
+		case "log-redact":
+			c.Log.Redact = *logRedact
+		case "admin-password":
+			c.AdminPassword = *adminPassword
+		case "drain":
+			c.Drain = *drain
+		case "max-participants":
+			c.MaxParticipants = *maxParticipants
+		case "tls-cert":
+			c.TLS.Cert = *tlsCert
+		case "tls-key":
+			c.TLS.Key = *tlsKey
+		case "tls-acme":
+			c.TLS.ACME.Domains = splitList(*tlsACME)
+		case "tls-self-signed":
+			c.TLS.SelfSigned = *tlsSelfSigned
+		case "tls-redirect":
+			c.TLS.Redirect = *tlsRedirect
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+
+	if c.BaseURL == "" {
+		// The default is computed after parsing, so it uses the configured port.
+		scheme := "http"
+		if c.TLS.Enabled() {
+			scheme = "https"
+		}
+		if _, port, err := net.SplitHostPort(c.Listen); err == nil {
+			c.BaseURL = scheme + "://localhost:" + port
+		}
+	} else if !strings.Contains(c.BaseURL, "://") {
+		// Bare domain names (e.g. -d www.example.com) are served over HTTPS.
+		c.BaseURL = "https://" + c.BaseURL
+	}
+	c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+
+	if c.OIDC.Enabled() && c.OIDC.RedirectURL == "" {
+		c.OIDC.RedirectURL = c.BaseURL + "/auth/callback"
+	}
+
+	return c, c.Validate()
+}
+
+// loadEnv overrides the configuration with the FUSECHAT_* environment variables that are set.
+func (c *Config) loadEnv() error {
+	texts := map[string]*string{
+		"FUSECHAT_LISTEN":             &c.Listen,
+		"FUSECHAT_BASE_URL":           &c.BaseURL,
+		"FUSECHAT_COOKIE_SECRET":      &c.CookieSecret,
+		"FUSECHAT_ADMIN_PASSWORD":     &c.AdminPassword,
+		"FUSECHAT_TLS_CERT":           &c.TLS.Cert,
+		"FUSECHAT_TLS_KEY":            &c.TLS.Key,
+		"FUSECHAT_TLS_REDIRECT":       &c.TLS.Redirect,
+		"FUSECHAT_ACME_CACHE_DIR":     &c.TLS.ACME.CacheDir,
+		"FUSECHAT_ACME_EMAIL":         &c.TLS.ACME.Email,
+		"FUSECHAT_ACME_DIRECTORY":     &c.TLS.ACME.DirectoryURL,
+		"FUSECHAT_STORAGE":            &c.Storage.Backend,
+		"FUSECHAT_STORAGE_DIR":        &c.Storage.Dir,
+		"FUSECHAT_LOG_LEVEL":          &c.Log.Level,
+		"FUSECHAT_LOG_FORMAT":         &c.Log.Format,
+		"FUSECHAT_OIDC_ISSUER":        &c.OIDC.Issuer,
+		"FUSECHAT_OIDC_CLIENT_ID":     &c.OIDC.ClientID,
+		"FUSECHAT_OIDC_CLIENT_SECRET": &c.OIDC.ClientSecret,
+		"FUSECHAT_OIDC_REDIRECT_URL":  &c.OIDC.RedirectURL,
+		"FUSECHAT_OIDC_GROUPS_CLAIM":  &c.OIDC.GroupsClaim,
+	}
+	for name, value := range texts {
+		if env, ok := os.LookupEnv(name); ok {
+			*value = env
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"FUSECHAT_FUSE_DURATION":        &c.Fuse.Duration,
+		"FUSECHAT_FUSE_MAX_DURATION":    &c.Fuse.MaxDuration,
+		"FUSECHAT_MAX_LIFETIME":         &c.Fuse.MaxLifetime,
+		"FUSECHAT_DRAIN":                &c.Drain,
+		"FUSECHAT_TLS_HSTS":             &c.TLS.HSTS,
+		"FUSECHAT_IDENTITY_MAX_AGE":     &c.IdentityMaxAge,
+		"FUSECHAT_OIDC_SESSION_MAX_AGE": &c.OIDC.SessionMaxAge,
+	}
+	for name, value := range durations {
+		if env, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(env)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*value = d
+		}
+	}
+
+	floats := map[string]*float64{
+		"FUSECHAT_RATE_MESSAGES": &c.RateLimit.Messages,
+		"FUSECHAT_RATE_CHATS":    &c.RateLimit.Chats,
+		"FUSECHAT_RATE_LOOKUPS":  &c.RateLimit.Lookups,
+	}
+	for name, value := range floats {
+		if env, ok := os.LookupEnv(name); ok {
+			f, err := strconv.ParseFloat(env, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*value = f
+		}
+	}
+
+	ints := map[string]*int{
+		"FUSECHAT_RATE_MESSAGE_BURST": &c.RateLimit.MessageBurst,
+		"FUSECHAT_MAX_PARTICIPANTS":   &c.MaxParticipants,
+		"FUSECHAT_MAX_CHATS":          &c.Limits.Chats,
+		"FUSECHAT_MAX_CONNECTIONS":    &c.Limits.Connections,
+		"FUSECHAT_MAX_MESSAGES":       &c.Limits.Messages,
+		"FUSECHAT_MAX_BYTES":          &c.Limits.Bytes,
+	}
+	for name, value := range ints {
+		if env, ok := os.LookupEnv(name); ok {
+			i, err := strconv.Atoi(env)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*value = i
+		}
+	}
+
+	if env, ok := os.LookupEnv("FUSECHAT_FUSE_WARNINGS"); ok {
+		warnings, err := parseDurations(env)
+		if err != nil {
+			return fmt.Errorf("FUSECHAT_FUSE_WARNINGS: %w", err)
+		}
+		c.Fuse.Warnings = warnings
+	}
+
+	bools := map[string]*bool{
+		"FUSECHAT_LOG_REDACT":      &c.Log.Redact,
+		"FUSECHAT_TLS_SELF_SIGNED": &c.TLS.SelfSigned,
+		"FUSECHAT_INVITE_CODES":    &c.InviteCodes,
+		"FUSECHAT_EVICT_IDLE":      &c.Limits.EvictIdle,
+	}
+	for name, value := range bools {
+		if env, ok := os.LookupEnv(name); ok {
+			b, err := strconv.ParseBool(env)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*value = b
+		}
+	}
+
+	lists := map[string]*[]string{
+		"FUSECHAT_ACME_DOMAINS":         &c.TLS.ACME.Domains,
+		"FUSECHAT_OIDC_SCOPES":          &c.OIDC.Scopes,
+		"FUSECHAT_OIDC_ALLOWED_DOMAINS": &c.OIDC.AllowedDomains,
+		"FUSECHAT_OIDC_ALLOWED_GROUPS":  &c.OIDC.AllowedGroups,
+		"FUSECHAT_TRUSTED_PROXIES":      &c.TrustedProxies,
+	}
+	for name, value := range lists {
+		if env, ok := os.LookupEnv(name); ok {
+			*value = splitList(env)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the configuration for invalid or contradicting values.
+func (c *Config) Validate() error {
+	errs := make([]error, 0)
+
+	if c.Listen == "" {
+		errs = append(errs, errors.New("listen address is empty"))
+	}
+
+	if u, err := url.Parse(c.BaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("base URL: %w", err))
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("base URL %q must be an absolute http or https URL", c.BaseURL))
+	} else if c.TLS.Enabled() && u.Scheme != "https" {
+		// Otherwise the HTTPS redirect and invite links send clients back to plain HTTP.
+		errs = append(errs, fmt.Errorf("base URL %q must be an https URL when TLS is enabled", c.BaseURL))
+	}
+
+	if c.Fuse.Duration <= 0 {
+		errs = append(errs, errors.New("fuse duration must be positive"))
+	}
+	if c.Fuse.MaxDuration < c.Fuse.Duration {
+		errs = append(errs, errors.New("maximum fuse duration must not be shorter than the fuse duration"))
+	}
+	if c.Fuse.MaxLifetime <= 0 {
+		errs = append(errs, errors.New("maximum lifetime must be positive"))
+	}
+	for _, warning := range c.Fuse.Warnings {
+		if warning <= 0 {
+			errs = append(errs, fmt.Errorf("warning threshold %s must be positive", warning))
+		}
+	}
+
+	if c.IdentityMaxAge < cookieRenewAfter {
+		errs = append(errs, fmt.Errorf("identity max age must be at least %s", cookieRenewAfter))
+	}
+
+	if c.MaxParticipants < 2 {
+		errs = append(errs, errors.New("maximum participants must be at least 2"))
+	}
+
+	if c.Limits.Chats < 0 || c.Limits.Connections < 0 || c.Limits.Messages < 0 || c.Limits.Bytes < 0 {
+		errs = append(errs, errors.New("limits must not be negative"))
+	}
+
+	if c.RateLimit.Messages < 0 || c.RateLimit.Chats < 0 || c.RateLimit.Lookups < 0 {
+		errs = append(errs, errors.New("rate limits must not be negative"))
+	}
+	if c.RateLimit.Messages > 0 && c.RateLimit.MessageBurst < 1 {
+		errs = append(errs, errors.New("message burst must be at least 1"))
+	}
+	if _, err := parsePrefixes(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted proxies: %w", err))
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, errors.New("TLS needs both a certificate and a key"))
+	}
+	sources := 0
+	for _, enabled := range []bool{c.TLS.Cert != "", len(c.TLS.ACME.Domains) > 0, c.TLS.SelfSigned} {
+		if enabled {
+			sources++
+		}
+	}
+	if sources > 1 {
+		errs = append(errs, errors.New("TLS needs exactly one of certificate files, ACME or a self-signed certificate"))
+	}
+	if len(c.TLS.ACME.Domains) > 0 && c.TLS.ACME.CacheDir == "" {
+		errs = append(errs, errors.New("ACME needs a cache directory"))
+	}
+	if c.TLS.Redirect != "" && !c.TLS.Enabled() {
+		errs = append(errs, errors.New("redirecting to HTTPS needs TLS to be enabled"))
+	}
+	if c.TLS.HSTS < 0 {
+		errs = append(errs, errors.New("HSTS max-age must not be negative"))
+	}
+
+	if c.OIDC.Enabled() && c.OIDC.ClientID == "" {
+		errs = append(errs, errors.New("OIDC needs a client ID"))
+	}
+	if c.OIDC.Enabled() && len(c.OIDC.AllowedGroups) > 0 && c.OIDC.GroupsClaim == "" {
+		errs = append(errs, errors.New("OIDC allowed groups need a groups claim"))
+	}
+	if c.OIDC.Enabled() && c.OIDC.SessionMaxAge <= 0 {
+		errs = append(errs, errors.New("OIDC session max age must be positive"))
+	}
+
+	switch c.Storage.Backend {
+	case "memory":
+	case "dir":
+		if c.Storage.Dir == "" {
+			errs = append(errs, errors.New("storage backend dir needs a directory"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown storage backend %q", c.Storage.Backend))
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("unknown log format %q", c.Log.Format))
+	}
+
+	return errors.Join(errs...)
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseDurations parses a comma separated list of durations, e.g. "30s,10s".
+func parseDurations(s string) ([]time.Duration, error) {
+	durations := make([]time.Duration, 0)
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		durations = append(durations, d)
+	}
+	return durations, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	// csrfHeader is the header htmx requests carry the CSRF token in.
+	csrfHeader = "X-CSRF-Token"
+	// csrfField is the form field plain HTML forms carry the CSRF token in.
+	csrfField = "csrf_token"
+)
+
+// csrfToken returns the CSRF token of the client.
+// The token is derived from the client ID, so it is valid as long as the client cookie is.
+func csrfToken(client *Client) string {
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write([]byte("csrf:" + client.Id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CSRFMiddleware rejects state-changing requests that do not carry the CSRF token of the client cookie,
+// either in the X-CSRF-Token header or in the csrf_token form field.
+// Safe methods are passed through.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client, err := parseClientCookie(r)
+		if err != nil {
+			http.Error(w, "missing client cookie", http.StatusForbidden)
+			return
+		}
+
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			// Messages may carry an attachment, limit the body before the form is parsed.
+			r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize+1<<20)
+			token = r.FormValue(csrfField)
+		}
+
+		if !hmac.Equal([]byte(token), []byte(csrfToken(client))) {
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientContext returns the request context with the client added, creating the client cookie if needed.
+// Used by pages outside of a chat, so their forms can carry the CSRF token.
+func clientContext(w http.ResponseWriter, r *http.Request) context.Context {
+	return context.WithValue(r.Context(), ContextClientKey, newClient(w, r, nil))
+}
+
+// csrf returns the CSRF token of the client stored in the context, used by the templates.
+func csrf(ctx context.Context) string {
+	client, ok := ctx.Value(ContextClientKey).(*Client)
+	if !ok {
+		return ""
+	}
+	return csrfToken(client)
+}
+
+// csrfHeaders returns the hx-headers value adding the CSRF token to all htmx requests.
+func csrfHeaders(ctx context.Context) string {
+	token := csrf(ctx)
+	if token == "" {
+		return ""
+	}
+	headers, _ := json.Marshal(map[string]string{csrfHeader: token})
+	return string(headers)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// dashboardInterval is the time between updates of the dashboard stream, keeping the remaining fuse times current.
+	dashboardInterval time.Duration = time.Second
+	// previewLength is the maximum number of characters of a message preview on the dashboard.
+	previewLength int = 80
+)
+
+// dashboards wakes up the dashboard streams of a client when one of its chats changes.
+var dashboards = &dashboardHub{streams: make(map[string]map[chan struct{}]bool)}
+
+// dashboardHub keeps track of the open dashboard streams of each client. It is safe for concurrent use.
+// Chats notify it with their lock held, so it must never take a chat's lock.
+type dashboardHub struct {
+	mu      sync.Mutex
+	streams map[string]map[chan struct{}]bool
+}
+
+// subscribe returns a channel that receives a value whenever one of the client's chats changes.
+// Changes that happen while the stream is busy are coalesced into a single value.
+func (h *dashboardHub) subscribe(clientId string) chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changed := make(chan struct{}, 1)
+	if h.streams[clientId] == nil {
+		h.streams[clientId] = make(map[chan struct{}]bool)
+	}
+	h.streams[clientId][changed] = true
+	return changed
+}
+
+// unsubscribe removes the channel returned by subscribe.
+func (h *dashboardHub) unsubscribe(clientId string, changed chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.streams[clientId], changed)
+	if len(h.streams[clientId]) == 0 {
+		delete(h.streams, clientId)
+	}
+}
+
+// notify tells the client's dashboard streams that one of its chats changed, without blocking.
+func (h *dashboardHub) notify(clientId string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for changed := range h.streams[clientId] {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notifyMembers tells the dashboards of every member that the chat changed.
+// It must be called with the chat's lock held.
+func (c *Chat) notifyMembers() {
+	for id := range c.members {
+		dashboards.notify(id)
+	}
+}
+
+// MarkRead marks every message of the chat as read by the client.
+func (c *Chat) MarkRead(client *Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.members[client.Id]; ok && c.read[client.Id] < c.posted {
+		c.read[client.Id] = c.posted
+		dashboards.notify(client.Id)
+	}
+}
+
+// ChatSummary is a snapshot of a chat from the view of one of its members, shown on the dashboard.
+type ChatSummary struct {
+	Id        string
+	Name      string
+	Owner     string
+	Remaining time.Duration
+	Paused    bool
+	// Unread is the number of messages of other members posted since the member last read the chat.
+	Unread int
+	// LastAuthor and LastText preview the latest message, both are empty if the chat has no messages.
+	LastAuthor string
+	LastText   string
+}
+
+// Summary returns a snapshot of the chat from the view of the given member.
+func (c *Chat) Summary(client *Client) ChatSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	summary := ChatSummary{
+		Id:        c.id,
+		Name:      c.code,
+		Owner:     c.owner.Name,
+		Remaining: max(time.Until(c.endTime).Round(time.Second), 0),
+		Paused:    c.paused,
+	}
+	if summary.Name == "" {
+		summary.Name = c.id[:8]
+	}
+
+	read := c.read[client.Id]
+	for _, message := range c.messages {
+		if message.seq > read && message.client.Id != client.Id {
+			summary.Unread++
+		}
+	}
+
+	if len(c.messages) > 0 {
+		last := c.messages[len(c.messages)-1]
+		summary.LastAuthor = last.client.Name
+		summary.LastText = last.preview()
+	}
+	return summary
+}
+
+// preview returns a short single line version of the message for the dashboard.
+// Burn-after-read messages are not previewed, they should only be read in the chat itself.
+func (m *Message) preview() string {
+	switch {
+	case m.burnAfterRead:
+		return "(burns after read)"
+	case m.system:
+		return m.text
+	case strings.TrimSpace(m.text) == "" && m.attachment != nil:
+		return "sent " + m.attachment.name
+	}
+
+	text := strings.Join(strings.Fields(m.text), " ")
+	if utf8.RuneCountInString(text) > previewLength {
+		text = string([]rune(text)[:previewLength-1]) + "…"
+	}
+	return text
+}
+
+// summaries returns the summaries of all chats the client is a member of, oldest first.
+func summaries(client *Client) []ChatSummary {
+	list := chats.ListByMember(client.Id)
+	summaries := make([]ChatSummary, 0, len(list))
+	for _, chat := range list {
+		summaries = append(summaries, chat.Summary(client))
+	}
+	return summaries
+}
+
+// DashboardHandler renders the DashboardView listing the chats the client is a member of.
+func DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := clientContext(w, r)
+	client := ctx.Value(ContextClientKey).(*Client)
+
+	err := DashboardView(summaries(client)).Render(ctx, w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DashboardStreamHandler keeps the client's dashboard up to date over a single server-sent event stream,
+// no matter how many chats the client is a member of.
+// The list of chats is sent as a "chats" event whenever one of them changes and every dashboardInterval,
+// so the stream needs no heartbeat. Like chat connections, dashboard streams count towards the server's connection limit.
+func DashboardStreamHandler(w http.ResponseWriter, r *http.Request) {
+	client, err := parseClientCookie(r)
+	if err != nil {
+		http.Error(w, "unknown client", http.StatusUnauthorized)
+		return
+	}
+
+	if err := reserveConnection(); err != nil {
+		renderServerFull(w, r)
+		return
+	}
+	defer releaseConnection()
+
+	changed := dashboards.subscribe(client.Id)
+	defer dashboards.unsubscribe(client.Id, changed)
+
+	write, err := startStream(w)
+	if err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+
+		err := write(func() error { return writeServerEvent(w, r, "chats", DashboardChatsView(summaries(client))) })
+		if err != nil {
+			// The client is gone or does not keep up, it reconnects if it is still around.
+			deadConnectionsCounter.Inc()
+			slog.Debug("dashboard write failed", clientAttr(client), slog.Any("error", err))
+			return
+		}
+	}
+}
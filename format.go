@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/a-h/templ"
+)
+
+var (
+	inlineCodePattern = regexp.MustCompile("`([^`\n]+)`")
+	boldPattern       = regexp.MustCompile(`\*\*([^*\n<>]+)\*\*`)
+	urlPattern        = regexp.MustCompile(`https?://[^\s<>"']+[^\s<>"'.,;:!?)]`)
+)
+
+// FormatMessage renders the given text using a small, safe subset of Markdown.
+// The text is HTML escaped before any formatting is applied, so the only markup
+// in the result is the markup generated here. Supported are fenced code blocks,
+// inline code, **bold**, *italic* (or _italic_), auto-linked http(s) URLs and line breaks.
+func FormatMessage(text string) string {
+	sb := &strings.Builder{}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	// Every odd part is the content of a fenced code block.
+	parts := strings.Split(text, "```")
+	for i, part := range parts {
+		if i%2 == 1 && i < len(parts)-1 {
+			// Drop the optional language hint and the line break after the fence.
+			if nl := strings.IndexByte(part, '\n'); nl >= 0 && !strings.ContainsAny(part[:nl], " \t") {
+				part = part[nl+1:]
+			}
+			sb.WriteString("<pre><code>")
+			sb.WriteString(html.EscapeString(strings.TrimSuffix(part, "\n")))
+			sb.WriteString("</code></pre>")
+			continue
+		}
+		if i%2 == 1 {
+			// An unterminated fence is kept as plain text.
+			sb.WriteString("```")
+		} else if i > 0 {
+			// The code block already ends the line.
+			part = strings.TrimPrefix(part, "\n")
+		}
+		sb.WriteString(formatInline(part))
+	}
+
+	return sb.String()
+}
+
+// formatInline formats a block of text outside of fenced code blocks.
+// Inline code spans are cut out first so their content is never formatted.
+func formatInline(text string) string {
+	sb := &strings.Builder{}
+	last := 0
+	for _, loc := range inlineCodePattern.FindAllStringSubmatchIndex(text, -1) {
+		sb.WriteString(formatSpan(text[last:loc[0]]))
+		sb.WriteString("<code>")
+		sb.WriteString(html.EscapeString(text[loc[2]:loc[3]]))
+		sb.WriteString("</code>")
+		last = loc[1]
+	}
+	sb.WriteString(formatSpan(text[last:]))
+	return sb.String()
+}
+
+// formatSpan escapes the given text and applies links, emphasis and line breaks.
+func formatSpan(text string) string {
+	sb := &strings.Builder{}
+	last := 0
+	for _, loc := range urlPattern.FindAllStringIndex(text, -1) {
+		sb.WriteString(formatEmphasis(html.EscapeString(text[last:loc[0]])))
+		url := html.EscapeString(text[loc[0]:loc[1]])
+		sb.WriteString(`<a href="` + url + `" target="_blank" rel="noopener nofollow">` + url + `</a>`)
+		last = loc[1]
+	}
+	sb.WriteString(formatEmphasis(html.EscapeString(text[last:])))
+	return strings.ReplaceAll(sb.String(), "\n", "<br/>")
+}
+
+// formatEmphasis applies bold and italic formatting to already escaped text.
+// The text contains no angle brackets but the tags of previous passes, so emphasis is only applied
+// to spans without brackets: the passes cannot produce overlapping tags like <em><strong>a</em></strong>.
+func formatEmphasis(escaped string) string {
+	escaped = boldPattern.ReplaceAllString(escaped, "<strong>$1</strong>")
+	escaped = formatItalic(escaped, '*')
+	return formatItalic(escaped, '_')
+}
+
+// formatItalic wraps text between single delimiters on the same line in <em> tags.
+// A delimiter only opens after and only closes before a non-word character. The neighboring characters
+// are checked without consuming them (Go's regexp has no lookaround), so adjacent spans like "_a_ _b_" both match.
+func formatItalic(escaped string, delim byte) string {
+	sb := &strings.Builder{}
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] == delim && (i == 0 || !isWordByte(escaped[i-1], delim)) {
+			end := strings.IndexAny(escaped[i+1:], string(delim)+"\n")
+			j := i + 1 + end
+			if end > 0 && escaped[j] == delim && (j+1 == len(escaped) || !isWordByte(escaped[j+1], delim)) &&
+				!strings.ContainsAny(escaped[i+1:j], "<>") {
+				sb.WriteString("<em>" + escaped[i+1:j] + "</em>")
+				i = j
+				continue
+			}
+		}
+		sb.WriteByte(escaped[i])
+	}
+	return sb.String()
+}
+
+// isWordByte reports whether the byte is an ASCII word character or the delimiter itself.
+func isWordByte(b byte, delim byte) bool {
+	return b == delim || b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// formattedText returns a component that writes the formatted text without escaping it again.
+func formattedText(text string) templ.Component {
+	return templ.ComponentFunc(func(ctx context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, FormatMessage(text))
+		return err
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestFormatMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"escapes html", "<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{"escapes entities", `a & "b"`, "a &amp; &#34;b&#34;"},
+		{"line breaks", "a\r\nb", "a<br/>b"},
+		{"bold and italic", "**bold** and *it*", "<strong>bold</strong> and <em>it</em>"},
+		{"adjacent italics", "_a_ _b_", "<em>a</em> <em>b</em>"},
+		{"adjacent asterisk italics", "*a* *b*", "<em>a</em> <em>b</em>"},
+		{"italic after rejected delimiter", "x_y _z_", "x_y <em>z</em>"},
+		{"no italics inside words", "snake_case_name and 2*3*4", "snake_case_name and 2*3*4"},
+		{"no italics across lines", "_a\nb_", "_a<br/>b_"},
+		{"escaped italics", "*<b>*", "<em>&lt;b&gt;</em>"},
+		{"italic inside bold", "**_a_**", "<strong><em>a</em></strong>"},
+		{"no italics around tags", "_**b**_", "_<strong>b</strong>_"},
+		{"no overlapping emphasis", "_**a_ b**", "_<strong>a_ b</strong>"},
+		{"no overlapping italics", "*_a*_", "*<em>a*</em>"},
+		{
+			"link",
+			"see https://example.com/path.",
+			`see <a href="https://example.com/path" target="_blank" rel="noopener nofollow">https://example.com/path</a>.`,
+		},
+		{
+			"link ends before double quote",
+			`https://example.com/a"onmouseover="alert(1)`,
+			`<a href="https://example.com/a" target="_blank" rel="noopener nofollow">https://example.com/a</a>&#34;onmouseover=&#34;alert(1)`,
+		},
+		{
+			"link ends before single quote",
+			"https://example.com/x'y",
+			`<a href="https://example.com/x" target="_blank" rel="noopener nofollow">https://example.com/x</a>&#39;y`,
+		},
+		{
+			"link query is escaped",
+			"https://example.com/?a=1&b=<2>",
+			`<a href="https://example.com/?a=1&amp;b=" target="_blank" rel="noopener nofollow">https://example.com/?a=1&amp;b=</a>&lt;2&gt;`,
+		},
+		{"no javascript links", "javascript:alert(1)", "javascript:alert(1)"},
+		{"inline code", "`<i>` *x*", "<code>&lt;i&gt;</code> <em>x</em>"},
+		{"inline code is not formatted", "`*x* https://example.com`", "<code>*x* https://example.com</code>"},
+		{"fence", "```go\n<b>x</b>\n```\nafter", "<pre><code>&lt;b&gt;x&lt;/b&gt;</code></pre>after"},
+		{"fence is not formatted", "```\n*x* https://example.com\n```", "<pre><code>*x* https://example.com</code></pre>"},
+		{"fence without language", "```<b>x</b>```", "<pre><code>&lt;b&gt;x&lt;/b&gt;</code></pre>"},
+		{"unterminated fence", "```\n<b>x</b>", "```<br/>&lt;b&gt;x&lt;/b&gt;"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := FormatMessage(test.text); got != test.want {
+				t.Errorf("FormatMessage(%q) = %q, want %q", test.text, got, test.want)
+			}
+		})
+	}
+}
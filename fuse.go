@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrFuseAtMaximum is returned if the fuse can not be extended, it is at the maximum fuse duration or the chat's deadline.
+var ErrFuseAtMaximum = errors.New("The fuse can not be extended any further.")
+
+// Extend adds the given duration to the chat's fuse, bounded by the configured maximum fuse duration and the chat's deadline.
+// A system message records who extended the fuse and by how much it actually grew.
+// Returns ErrFuseAtMaximum if the bounds leave no room to extend the fuse by at least a second.
+func (c *Chat) Extend(d time.Duration, client *Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	start := c.endTime
+	c.endTime = c.endTime.Add(d)
+	if max := time.Now().Add(config.Fuse.MaxDuration); c.endTime.After(max) {
+		c.endTime = max
+	}
+	c.clampEndTime()
+
+	added := c.endTime.Sub(start).Truncate(time.Second)
+	if added <= 0 {
+		c.endTime = start
+		return ErrFuseAtMaximum
+	}
+	c.endTime = start.Add(added)
+
+	c.postSystemMessage(client, fmt.Sprintf("added %s to the fuse", shortDuration(added)))
+	return nil
+}
+
+// SetPaused pauses or resumes the chat's fuse. A system message records who did it.
+// A paused fuse only stops while every member of the chat is connected.
+func (c *Chat) SetPaused(paused bool, client *Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.paused == paused {
+		return
+	}
+	c.paused = paused
+
+	if paused {
+		c.postSystemMessage(client, "paused the fuse while everyone is connected")
+	} else {
+		c.postSystemMessage(client, "resumed the fuse")
+	}
+}
+
+// Paused reports whether the chat's fuse is paused.
+func (c *Chat) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.paused
+}
+
+// Burn records who burned the fuse in a system message and ends the chat immediately.
+func (c *Chat) Burn(client *Client) {
+	c.mu.Lock()
+	c.postSystemMessage(client, "burned the fuse")
+	c.mu.Unlock()
+
+	c.End(EndReasonManual)
+}
+
+// sendWarnings sends a warning event to every connection for each warning threshold the remaining time just dropped below.
+// A threshold is rearmed once the fuse has been extended beyond it again.
+// Thresholds not below the chat's fuse duration are skipped: a freshly reset fuse would be below them,
+// so they would never be rearmed.
+// It must be called with the chat's lock held.
+func (c *Chat) sendWarnings(now time.Time) {
+	remaining := c.endTime.Sub(now)
+	for _, threshold := range config.Fuse.Warnings {
+		if threshold >= c.duration {
+			continue
+		}
+		if remaining > threshold {
+			c.warned[threshold] = false
+			continue
+		}
+		if c.warned[threshold] || remaining <= 0 {
+			continue
+		}
+
+		c.warned[threshold] = true
+		event := &ServerEvent{name: "warning", data: FuseWarningView(threshold)}
+		for _, connection := range c.conns {
+			connection.send(event)
+		}
+	}
+}
+
+// allConnected reports whether every member of the chat has at least one open connection.
+// It must be called with the chat's lock held.
+func (c *Chat) allConnected() bool {
+	connected := make(map[string]bool)
+	for _, connection := range c.conns {
+		connected[connection.client.Id] = true
+	}
+	for id := range c.members {
+		if !connected[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// postSystemMessage broadcasts a system message about an action of the given client.
+// System messages do not reset the fuse, they are dropped once the chat has ended.
+// It must be called with the chat's lock held.
+func (c *Chat) postSystemMessage(client *Client, text string) {
+	if c.ended {
+		return
+	}
+	c.broadcast(&Message{
+		id:        uuid.New().String(),
+		text:      text,
+		client:    client,
+		createdAt: time.Now(),
+		system:    true,
+		seenBy:    make(map[string]*Client),
+	})
+}
+
+// lifetimeOptions are the maximum lifetimes a chat can be created with, if the server allows them.
+var lifetimeOptions = []time.Duration{15 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+// LifetimeOptions returns the lifetime options allowed by the server's maximum lifetime.
+// The server's maximum lifetime itself is always the last option.
+func LifetimeOptions() []time.Duration {
+	options := make([]time.Duration, 0, len(lifetimeOptions)+1)
+	for _, option := range lifetimeOptions {
+		if option < config.Fuse.MaxLifetime {
+			options = append(options, option)
+		}
+	}
+	return append(options, config.Fuse.MaxLifetime)
+}
+
+// shortDuration formats the duration without trailing zero units, e.g. "5m" instead of "5m0s".
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// ExtendFuseHandler adds the number of minutes given in the "minutes" form value to the chat's fuse.
+// The minutes are capped at the maximum fuse duration, larger values could not be reached anyway.
+// It responds with the updated ChatStatusView, or a 409 status if the fuse can not be extended any further.
+func ExtendFuseHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+	client := r.Context().Value(ContextClientKey).(*Client)
+
+	minutes, err := strconv.Atoi(r.FormValue("minutes"))
+	if err != nil || minutes <= 0 {
+		http.Error(w, "invalid number of minutes", http.StatusBadRequest)
+		return
+	}
+	d := config.Fuse.MaxDuration
+	if minutes < int(config.Fuse.MaxDuration/time.Minute) {
+		d = time.Duration(minutes) * time.Minute
+	}
+
+	if err := chat.Extend(d, client); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	renderStatus(w, r, chat)
+}
+
+// PauseFuseHandler pauses the chat's fuse if the "paused" form value is "true", otherwise it resumes the fuse.
+// It responds with the updated ChatStatusView.
+func PauseFuseHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+	client := r.Context().Value(ContextClientKey).(*Client)
+
+	chat.SetPaused(r.FormValue("paused") == "true", client)
+	renderStatus(w, r, chat)
+}
+
+// BurnFuseHandler ends the chat immediately and redirects the client to the end page.
+// Like ending the chat, burning the fuse is reserved to the owner.
+func BurnFuseHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+	client := r.Context().Value(ContextClientKey).(*Client)
+
+	chat.Burn(client)
+	w.Header().Set("HX-Redirect", "/end")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// renderStatus renders the ChatStatusView of the chat.
+func renderStatus(w http.ResponseWriter, r *http.Request, chat *Chat) {
+	client := r.Context().Value(ContextClientKey).(*Client)
+
+	err := ChatStatusView(chat, client).Render(r.Context(), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"rsc.io/qr"
+)
+
+// ErrInviteInvalid is returned when an invite is unknown, expired, used up or revoked.
+var ErrInviteInvalid = errors.New("This invite link is invalid, expired or used up.")
+
+var (
+	// inviteUseOptions are the selectable numbers of uses of a new invite.
+	inviteUseOptions = []int{1, 5, 10}
+	// inviteExpiryOptions are the selectable expiries of a new invite.
+	inviteExpiryOptions = []time.Duration{15 * time.Minute, time.Hour, 24 * time.Hour}
+)
+
+// maxInviteUses is the largest number of uses an invite may have.
+const maxInviteUses = 100
+
+// Invite is a link minted by the owner that admits a limited number of clients until it expires,
+// even into a locked chat.
+type Invite struct {
+	token     string
+	maxUses   int
+	uses      int
+	createdAt time.Time
+	expires   time.Time
+}
+
+// URL returns the URL of the invite link.
+func (i *Invite) URL() string {
+	return fmt.Sprintf("%s/i/%s", config.BaseURL, i.token)
+}
+
+// Token returns the secret token of the invite.
+func (i *Invite) Token() string {
+	return i.token
+}
+
+// UsesLeft returns how many more clients the invite admits.
+func (i *Invite) UsesLeft() int {
+	return i.maxUses - i.uses
+}
+
+// ExpiresIn returns the time until the invite expires.
+func (i *Invite) ExpiresIn() time.Duration {
+	return time.Until(i.expires).Round(time.Second)
+}
+
+// valid reports whether the invite still admits clients at the given time.
+func (i *Invite) valid(now time.Time) bool {
+	return i.uses < i.maxUses && now.Before(i.expires)
+}
+
+// CreateInvite mints a new invite admitting up to maxUses clients within the given time.
+// The chat is locked by minting an invite, otherwise its own URL would admit anyone regardless of the invite's limits.
+// The owner may unlock it again.
+func (c *Chat) CreateInvite(maxUses int, ttl time.Duration) (*Invite, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	invite := &Invite{
+		token:     base64.RawURLEncoding.EncodeToString(b),
+		maxUses:   maxUses,
+		createdAt: now,
+		expires:   now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invites[invite.token] = invite
+	chats.AddInvite(invite.token, c)
+	c.locked = true
+	slog.Info("invite created", chatAttr(c), slog.Int("max_uses", maxUses), slog.Duration("ttl", ttl))
+	return invite, nil
+}
+
+// RevokeInvite deletes the invite with the given token, it admits nobody anymore.
+func (c *Chat) RevokeInvite(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeInvite(token)
+}
+
+// removeInvite deletes the invite. Tokens of other chats are ignored. Must be called with the lock held.
+func (c *Chat) removeInvite(token string) {
+	if _, ok := c.invites[token]; !ok {
+		return
+	}
+	delete(c.invites, token)
+	chats.RemoveInvite(token)
+}
+
+// Invites returns the outstanding invites, oldest first. Expired invites are dropped.
+func (c *Chat) Invites() []*Invite {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	invites := make([]*Invite, 0, len(c.invites))
+	for token, invite := range c.invites {
+		if !invite.valid(now) {
+			c.removeInvite(token)
+			continue
+		}
+		invites = append(invites, invite)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].createdAt.Before(invites[j].createdAt) })
+	return invites
+}
+
+// AdmitInvite adds the client to the chat's members using the invite with the given token, even if the chat is locked.
+// Every new member consumes one use of the invite, clients that are members already do not.
+// Returns ErrClientBanned if the client was kicked, ErrInviteInvalid if the invite does not admit anyone anymore
+// and ErrChatFull if the chat has no room for another participant.
+func (c *Chat) AdmitInvite(client *Client, token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.banned[client.Id] {
+		return ErrClientBanned
+	}
+
+	invite, ok := c.invites[token]
+	if !ok || !invite.valid(time.Now()) {
+		return ErrInviteInvalid
+	}
+	if _, ok := c.members[client.Id]; ok {
+		return nil
+	}
+	if !c.hasSeat(time.Now()) {
+		return ErrChatFull
+	}
+
+	// The seat is only held for a while, if the client never connects it is freed again.
+	c.addMember(client)
+	c.pending[client.Id] = time.Now()
+	invite.uses++
+	if invite.UsesLeft() <= 0 {
+		c.removeInvite(token)
+	}
+	slog.Info("client joined", chatAttr(c), clientAttr(client), slog.Bool("invite", true))
+	return nil
+}
+
+// inviteCodeWords is the number of words of a new invite code, e.g. "mostly-proud-walrus".
+const inviteCodeWords = 3
+
+// wordFiles holds the word lists of invite codes, taken from golang-petname (see words/petname.LICENSE).
+//
+//go:embed words/*.txt
+var wordFiles embed.FS
+
+var (
+	inviteAdverbs    = loadWords("adverbs")
+	inviteAdjectives = loadWords("adjectives")
+	inviteNames      = loadWords("names")
+)
+
+// loadWords returns the embedded word list with the given name.
+func loadWords(name string) []string {
+	data, err := wordFiles.ReadFile("words/" + name + ".txt")
+	if err != nil {
+		panic(err)
+	}
+	return strings.Fields(string(data))
+}
+
+// randomWord picks a word from the list with crypto/rand, invite codes are secrets.
+func randomWord(words []string) string {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	if err != nil {
+		panic(err)
+	}
+	return words[i.Int64()]
+}
+
+// newInviteCode generates a word-based invite code that is easy to read aloud and to type:
+// adverbs followed by an adjective and a name, like golang-petname does.
+func newInviteCode(words int) string {
+	code := make([]string, 0, words)
+	for i := 0; i < words-2; i++ {
+		code = append(code, randomWord(inviteAdverbs))
+	}
+	code = append(code, randomWord(inviteAdjectives), randomWord(inviteNames))
+	return strings.Join(code, "-")
+}
+
+// InviteURL returns the short invite URL of the chat, or its full URL if the chat has no invite code.
+func (c *Chat) InviteURL() string {
+	if c.code == "" {
+		return c.URL()
+	}
+	return fmt.Sprintf("%s/c/%s", config.BaseURL, c.code)
+}
+
+// Code returns the invite code of the chat, empty if invite codes are disabled.
+func (c *Chat) Code() string {
+	return c.code
+}
+
+// lookupChat returns the chat with the given ID or invite code.
+// Invite codes are short enough to be guessed, so failed lookups are rate limited per IP address
+// and no codes are resolved for an IP address that exceeded the limit.
+func lookupChat(idOrCode string, ip string) (*Chat, bool) {
+	if chat, ok := chats.Get(idOrCode); ok {
+		return chat, true
+	}
+
+	if _, err := uuid.Parse(idOrCode); err != nil && !lookupLimiter.Limited(ip) {
+		if chat, ok := chats.GetByCode(idOrCode); ok {
+			return chat, true
+		}
+	}
+
+	lookupLimiter.Allow(ip)
+	return nil, false
+}
+
+// QRCodeHandler responds with a PNG QR code of the chat's invite URL.
+func QRCodeHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+
+	code, err := qr.Encode(chat.InviteURL(), qr.M)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	code.Scale = 4
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(code.PNG())
+}
+
+// InviteHandler shows the page of an invite link, asking the client to join the chat.
+// Joining is a separate POST request, so link previews do not use up the invite.
+func InviteHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := inviteChat(w, r); !ok {
+		return
+	}
+
+	err := InviteView().Render(clientContext(w, r), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// JoinInviteHandler admits the client to the chat of the invite and redirects it to the chat.
+func JoinInviteHandler(w http.ResponseWriter, r *http.Request) {
+	chat, ok := inviteChat(w, r)
+	if !ok {
+		return
+	}
+
+	client := newClient(w, r, chat)
+	if err := chat.AdmitInvite(client, chi.URLParam(r, "token")); err != nil {
+		renderDenied(w, r.WithContext(context.WithValue(r.Context(), ContextClientKey, client)), http.StatusForbidden, err)
+		return
+	}
+
+	http.Redirect(w, r, "/c/"+chat.id, http.StatusSeeOther)
+}
+
+// inviteChat returns the chat of the invite token in the URL.
+// Failed lookups are rate limited per IP address like invite codes, if the lookup fails an error page is rendered.
+func inviteChat(w http.ResponseWriter, r *http.Request) (*Chat, bool) {
+	ip := remoteIP(r)
+	if lookupLimiter.Limited(ip) {
+		http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	chat, ok := chats.GetByInvite(chi.URLParam(r, "token"))
+	if !ok {
+		lookupLimiter.Allow(ip)
+		renderDenied(w, r, http.StatusNotFound, ErrInviteInvalid)
+		return nil, false
+	}
+	return chat, true
+}
+
+// CreateInviteHandler mints an invite with the "uses" and "expiry" form values.
+// The expiry is bounded by the chat's maximum lifetime.
+func CreateInviteHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+
+	uses, err := strconv.Atoi(r.FormValue("uses"))
+	if err != nil || uses < 1 || uses > maxInviteUses {
+		http.Error(w, "invalid number of uses", http.StatusBadRequest)
+		return
+	}
+
+	expiry, err := time.ParseDuration(r.FormValue("expiry"))
+	if err != nil || expiry <= 0 {
+		http.Error(w, "invalid expiry", http.StatusBadRequest)
+		return
+	}
+	expiry = min(expiry, time.Until(chat.Deadline()))
+
+	if _, err := chat.CreateInvite(uses, expiry); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderInvites(w, r, chat)
+}
+
+// RevokeInviteHandler revokes the invite given in the "token" form value.
+func RevokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+
+	chat.RevokeInvite(r.FormValue("token"))
+	renderInvites(w, r, chat)
+}
+
+// renderInvites renders the InvitesView of the chat.
+func renderInvites(w http.ResponseWriter, r *http.Request, chat *Chat) {
+	err := InvitesView(chat).Render(r.Context(), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
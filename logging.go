@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+const redacted string = "[redacted]"
+
+// setupLogger creates a structured logger writing to w with the given level ("debug", "info", "warn" or "error")
+// and format ("text" or "json") and sets it as the default logger.
+func setupLogger(w io.Writer, level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+
+	options := &slog.HandlerOptions{Level: l}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// clientAttr returns the log attributes of the client, its name is redacted if configured.
+func clientAttr(client *Client) slog.Attr {
+	name := client.Name
+	if config.Log.Redact {
+		name = redacted
+	}
+	return slog.Group("client", slog.String("id", client.Id), slog.String("name", name))
+}
+
+// textAttr returns the log attribute of a message text, the text is redacted if configured.
+func textAttr(text string) slog.Attr {
+	if config.Log.Redact {
+		return slog.String("text", redacted)
+	}
+	return slog.String("text", text)
+}
+
+// chatAttr returns the log attribute of the chat's ID.
+func chatAttr(chat *Chat) slog.Attr {
+	return slog.String("chat_id", chat.id)
+}
+
+// LoggingMiddleware logs every request after it has been served.
+// Requests are logged with the chi route pattern, so the logs can be grouped by route.
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("route", routePattern(r)),
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+		)
+	})
+}
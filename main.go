@@ -1,72 +1,194 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"fmt"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var port int
-var domain string
-
 func main() {
+	c, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	config = c
 
-	flag.IntVar(&port, "p", 8080, "Provide a port number")
-	flag.StringVar(&domain, "d", "localhost:"+fmt.Sprint(port), "Provide a domain name")
-	flag.Parse()
+	if err := setupLogger(os.Stderr, config.Log.Level, config.Log.Format); err != nil {
+		log.Fatal(err)
+	}
 
-	r := chi.NewRouter()
-	// r.Use(middleware.Logger)
+	if err := setupCookieSecret(config.CookieSecret); err != nil {
+		log.Fatal(err)
+	}
+
+	setupRateLimits(config.RateLimit)
+	if err := setupTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
+
+	if config.OIDC.Enabled() {
+		a, err := NewOIDCAuth(context.Background(), config.OIDC)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auth = a
+	}
 
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		err := IndexView().Render(r.Context(), w)
+	if config.Storage.Backend == "dir" {
+		store, err := NewDirBlobStore(config.Storage.Dir)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Fatal(err)
 		}
+		blobs = store
+	}
+
+	r := chi.NewRouter()
+	r.Use(LoggingMiddleware)
+	r.Use(MetricsMiddleware)
+	r.Use(HSTSMiddleware)
+	r.Use(SecurityHeadersMiddleware)
+
+	r.With(AdminMiddleware).Handle("/metrics", promhttp.Handler())
+	r.Get("/healthz", HealthHandler)
+	r.Get("/readyz", ReadyHandler)
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(AdminMiddleware)
+		r.Use(CSRFMiddleware)
+		r.Get("/", AdminHandler)
+		r.Post("/chats/{chatId}/end", AdminEndChatHandler)
+	})
+
+	r.Get("/", IndexHandler)
+	r.With(CSRFMiddleware, LoginRequiredMiddleware).Post("/new", NewChatHandler)
+	r.Route("/auth", func(r chi.Router) {
+		r.Get("/login", LoginHandler)
+		r.Get("/callback", CallbackHandler)
+		r.With(CSRFMiddleware).Post("/logout", LogoutHandler)
 	})
-	r.Get("/new", NewChatHandler)
+
+	r.Get("/my", DashboardHandler)
+	r.Get("/my/sse", DashboardStreamHandler)
+	r.Get("/settings", SettingsHandler)
+	r.With(CSRFMiddleware).Post("/settings", SaveSettingsHandler)
 	r.Get("/end", EndChatHandler)
+	r.Get("/full", ChatFullHandler)
+
+	r.Route("/i/{token}", func(r chi.Router) {
+		r.Use(CSRFMiddleware)
+		r.Use(LoginRequiredMiddleware)
+		r.Get("/", InviteHandler)
+		r.Post("/", JoinInviteHandler)
+	})
 
 	r.Route("/c/{chatId}", func(r chi.Router) {
 		r.Group(func(r chi.Router) {
+			r.Use(CSRFMiddleware)
+			r.Use(LoginRequiredMiddleware)
 			r.Use(ChatMiddleware)
 			r.Get("/", ChatHandler)
 			r.Post("/", PostMessageHandler)
 			r.Get("/sse", ReceiveMessageHandler)
+			r.Get("/files/{fileId}", FileHandler)
+			r.Get("/qr", QRCodeHandler)
+			r.Get("/moderation", ModerationHandler)
+			r.Post("/fuse/extend", ExtendFuseHandler)
+			r.Post("/fuse/pause", PauseFuseHandler)
+
+			r.Group(func(r chi.Router) {
+				r.Use(OwnerMiddleware)
+				r.Post("/kick", KickHandler)
+				r.Post("/lock", LockHandler)
+				r.Post("/transfer", TransferHandler)
+				r.Post("/end", EndHandler)
+				r.Post("/fuse/burn", BurnFuseHandler)
+				r.Post("/invites", CreateInviteHandler)
+				r.Post("/invites/revoke", RevokeInviteHandler)
+			})
 		})
 
 		r.Get("/status", ChatStatusHandler)
 	})
 
-	workDir, _ := os.Getwd()
-	filesDir := http.Dir(filepath.Join(workDir, "static"))
-	FileServer(r, "/static", filesDir)
+	r.Get("/static/*", AssetHandler)
 
-	http.ListenAndServe(":"+fmt.Sprint(port), r)
-}
+	// Open streams are bound to the base context, so they are closed on shutdown instead of blocking it.
+	baseCtx, closeStreams := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        config.Listen,
+		Handler:     r,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	server.RegisterOnShutdown(closeStreams)
+
+	// redirectServer serves plain HTTP next to HTTPS, if configured.
+	var redirectServer *http.Server
+	if config.TLS.Enabled() {
+		tlsConfig, redirect, err := newTLSConfig(config.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = tlsConfig
 
-// FileServer conveniently sets up a http.FileServer handler to serve
-// static files from a http.FileSystem.
-func FileServer(r chi.Router, path string, root http.FileSystem) {
-	if strings.ContainsAny(path, "{}*") {
-		panic("FileServer does not permit any URL parameters.")
+		if config.TLS.Redirect != "" {
+			redirectServer = &http.Server{Addr: config.TLS.Redirect, Handler: redirect}
+			go func() {
+				if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("redirect server stopped", slog.Any("error", err))
+				}
+			}()
+		}
 	}
 
-	if path != "/" && path[len(path)-1] != '/' {
-		r.Get(path, http.RedirectHandler(path+"/", http.StatusMovedPermanently).ServeHTTP)
-		path += "/"
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+
+		stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		<-stop.Done()
+
+		// Report not ready first, so the orchestrator stops sending new traffic.
+		ready.Store(false)
+		slog.Info("draining", slog.Duration("drain", config.Drain))
+		time.Sleep(config.Drain)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if redirectServer != nil {
+			redirectServer.Shutdown(ctx)
+		}
+		server.Shutdown(ctx)
+	}()
+
+	ready.Store(true)
+	slog.Info("listening", slog.String("address", config.Listen), slog.String("base_url", config.BaseURL))
+	if config.TLS.Enabled() {
+		// The certificates are provided by the server's TLS config.
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server stopped", slog.Any("error", err))
+		os.Exit(1)
 	}
-	path += "*"
 
-	r.Get(path, func(w http.ResponseWriter, r *http.Request) {
-		rctx := chi.RouteContext(r.Context())
-		pathPrefix := strings.TrimSuffix(rctx.RoutePattern(), "/*")
-		fs := http.StripPrefix(pathPrefix, http.FileServer(root))
-		fs.ServeHTTP(w, r)
-	})
+	// ListenAndServe returns as soon as the shutdown starts, wait for open requests to finish.
+	<-shutdownDone
+	slog.Info("server stopped")
 }
@@ -2,49 +2,231 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/a-h/templ"
 	"github.com/google/uuid"
 )
 
+const (
+	// BurnAfterReadDelay is the time a burn-after-read message stays visible after everyone received it.
+	BurnAfterReadDelay time.Duration = time.Duration(10) * time.Second
+
+	// sseHeartbeatInterval is the time between heartbeats on a quiet stream.
+	sseHeartbeatInterval time.Duration = 15 * time.Second
+	// sseWriteTimeout is the time a single write to a stream may take before the connection is considered dead.
+	sseWriteTimeout time.Duration = 10 * time.Second
+	// sseRetry is the delay clients wait before reconnecting a broken stream.
+	sseRetry time.Duration = 3 * time.Second
+)
+
+// burnOptions maps the values of the "burn" form field to the time after which a message is removed.
+var burnOptions = map[string]time.Duration{
+	"30s": 30 * time.Second,
+	"5m":  5 * time.Minute,
+}
+
 type Message struct {
-	text      string
-	client    *Client
-	createdAt time.Time
+	id         string
+	text       string
+	formatted  bool
+	attachment *Attachment
+	client     *Client
+	createdAt  time.Time
+	// system messages record actions of the client instead of text written by it.
+	system bool
+	// seq numbers the messages of a chat in the order they were posted, starting at 1.
+	seq int
+
+	// burnAfter is the time after which the message is removed, zero if the message lives as long as the chat.
+	burnAfter time.Duration
+	// burnAfterRead marks messages that are removed once every connected client received them.
+	burnAfterRead bool
+	// unread holds the IDs of the clients that have not yet received a burn-after-read message.
+	unread map[string]bool
+	// seenBy holds the clients (other than the author) the message has been delivered to, keyed by client ID.
+	// It is guarded by seenMu, since the message is rendered concurrently for every connection.
+	seenBy map[string]*Client
+	seenMu sync.Mutex
+}
+
+// markSeen adds the client to the clients that have seen the message.
+// It reports whether the client had not seen the message before.
+func (m *Message) markSeen(client *Client) bool {
+	m.seenMu.Lock()
+	defer m.seenMu.Unlock()
+
+	if m.seenBy[client.Id] != nil {
+		return false
+	}
+	m.seenBy[client.Id] = client
+	return true
+}
+
+// SeenBy returns the number of clients that have seen the message.
+func (m *Message) SeenBy() string {
+	m.seenMu.Lock()
+	defer m.seenMu.Unlock()
+
+	return fmt.Sprintf("Seen by %d", len(m.seenBy))
+}
+
+// SeenByNames returns the sorted names of the clients that have seen the message.
+func (m *Message) SeenByNames() string {
+	m.seenMu.Lock()
+	defer m.seenMu.Unlock()
+
+	names := make([]string, 0, len(m.seenBy))
+	for _, client := range m.seenBy {
+		names = append(names, client.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ServerEvent is a server-sent event that is rendered the same way for every connection.
+type ServerEvent struct {
+	name string
+	data templ.Component
 }
 
 // SendServerEvent sends a server event containing the message data to the client.
 // It writes the event data to the provided http.ResponseWriter and returns an error if any.
 // The isAuthor parameter indicates whether the current user is the author of the message.
-func (m *Message) SendServerEvent(w http.ResponseWriter, r *http.Request, isAuthor bool) error {
-	sb := &strings.Builder{}
-	sb.WriteString("event: message\ndata: ")
+func (m *Message) SendServerEvent(w http.ResponseWriter, r *http.Request, chat *Chat, isAuthor bool) error {
+	return writeServerEvent(w, r, "message", MessageView(chat, m, isAuthor))
+}
+
+// writeServerEvent renders the component and writes it as a server event with the given name.
+func writeServerEvent(w http.ResponseWriter, r *http.Request, name string, component templ.Component) error {
+	data := &strings.Builder{}
 
-	// Render the message data using the MessageView and write it to the strings.Builder
-	if err := MessageView(m, isAuthor).Render(r.Context(), sb); err != nil {
+	// Render the event data using the component and write it to the strings.Builder
+	if err := component.Render(r.Context(), data); err != nil {
 		return err
 	}
 
-	sb.WriteString("\n\n")
+	sb := &strings.Builder{}
+	sb.WriteString("event: " + name + "\n")
+
+	// Multiline data (e.g. code blocks) has to be split into multiple data fields.
+	for _, line := range strings.Split(data.String(), "\n") {
+		sb.WriteString("data: " + line + "\n")
+	}
+
+	sb.WriteString("\n")
 	_, err := fmt.Fprint(w, sb.String())
 	return err
 }
 
+// writeRetry writes the reconnection delay the client should use if the stream breaks.
+func writeRetry(w http.ResponseWriter, retry time.Duration) error {
+	_, err := fmt.Fprintf(w, "retry: %d\n\n", retry.Milliseconds())
+	return err
+}
+
+// writeHeartbeat writes an SSE comment, which clients ignore.
+// It keeps proxies with idle timeouts from cutting the stream and detects dead connections while the chat is quiet.
+func writeHeartbeat(w http.ResponseWriter) error {
+	_, err := fmt.Fprint(w, ": ping\n\n")
+	return err
+}
+
+// startStream starts a server-sent event stream and returns the function writing the events.
+// The written events are flushed right away. Every write gets a deadline of sseWriteTimeout,
+// so a stalled client does not keep the connection open forever.
+// The stream starts with the reconnection delay, before any proxy times out.
+func startStream(w http.ResponseWriter) (func(event func() error) error, error) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	rc := http.NewResponseController(w)
+	write := func(event func() error) error {
+		if err := rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		if err := event(); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	return write, write(func() error { return writeRetry(w, sseRetry) })
+}
+
+// writeFullEvent answers a message stream with a single full event, sending the client to the ChatFullView.
+// The last seat of the chat was taken since the client loaded the chat page.
+func writeFullEvent(w http.ResponseWriter, r *http.Request) {
+	if write, err := startStream(w); err == nil {
+		write(func() error { return writeServerEvent(w, r, "full", FullEventView()) })
+	}
+}
+
 // postMessageHandler handles the HTTP POST request for posting a message.
 // It receives the message from the request form and creates a new Message object.
-// The message is then passed to the chat's ReceiveMessage method.
+// Formatting is only applied if the sender opted in with the "format" checkbox.
+// An optional file upload is validated and stored as the message's attachment.
+// The "burn" field makes the message self-destruct after a fixed time or once it has been read.
+// Only a valid message reserves room within the server's limits, before it is passed to the chat's ReceiveMessage method.
 // Finally, it sets the HTTP status code to 204 (No Content) to indicate success.
+// Posting is rate limited per client.
 func PostMessageHandler(w http.ResponseWriter, r *http.Request) {
 	chat := r.Context().Value(ContextChatKey).(*Chat)
 	client := r.Context().Value(ContextClientKey).(*Client)
 
+	if !messageLimiter.Allow(client.Id) {
+		http.Error(w, "too many messages, slow down", http.StatusTooManyRequests)
+		return
+	}
+
+	// Leave some room for the other form fields on top of the file itself.
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize+1<<20)
+
 	message := &Message{
-		text:      r.FormValue("message"),
-		client:    client,
-		createdAt: time.Now(),
+		id:            uuid.New().String(),
+		text:          r.FormValue("message"),
+		formatted:     r.FormValue("format") == "on",
+		client:        client,
+		createdAt:     time.Now(),
+		burnAfter:     burnOptions[r.FormValue("burn")],
+		burnAfterRead: r.FormValue("burn") == "read",
+		seenBy:        make(map[string]*Client),
+	}
+
+	file, header, err := r.FormFile("file")
+	if err == nil {
+		defer file.Close()
+
+		message.attachment, err = storeAttachment(chat, file, header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if !errors.Is(err, http.ErrMissingFile) && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(message.text) == "" && message.attachment == nil {
+		http.Error(w, "message is empty", http.StatusBadRequest)
+		return
+	}
+
+	// Only valid messages may evict other chats to make room.
+	if err := reserveMessage(chat, message.size()); err != nil {
+		if message.attachment != nil {
+			blobs.Delete(chat.id, message.attachment.id)
+		}
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
 
 	chat.ReceiveMessage(message)
@@ -54,47 +236,77 @@ func PostMessageHandler(w http.ResponseWriter, r *http.Request) {
 
 // receiveMessageHandler handles the HTTP request for receiving messages.
 // It sets up the server-sent event (SSE) response and continuously sends messages to the client.
-// The SSE response is flushed after each message is sent.
+// The SSE response is flushed after each message or event is sent.
 // If SSE is not supported, it returns an internal server error.
 // The connection is tracked using a unique connection ID.
+// Connections beyond the chat's participant limit get a single full event,
+// connections beyond the server's limit with a 503 status.
+// Quiet streams get a heartbeat comment every sseHeartbeatInterval,
+// connections whose writes fail or take longer than sseWriteTimeout are dropped.
 func ReceiveMessageHandler(w http.ResponseWriter, r *http.Request) {
 	chat := r.Context().Value(ContextChatKey).(*Chat)
 	client := r.Context().Value(ContextClientKey).(*Client)
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
+	if _, ok := w.(http.Flusher); !ok {
 		http.Error(w, "SSE not supported", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
 	connectionId := uuid.New().String()
-	connection := &Connection{
-		client:  client,
-		receive: make(chan *Message),
+	connection := newConnection(client)
+	if err := chat.AddConnection(connectionId, connection); errors.Is(err, ErrServerFull) {
+		renderServerFull(w, r)
+		return
+	} else if errors.Is(err, ErrChatFull) {
+		writeFullEvent(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
-	chat.conns[connectionId] = connection
 
 	_, cancel := context.WithCancel(r.Context())
 	defer func() {
-		delete(chat.conns, connectionId)
+		chat.RemoveConnection(connectionId)
 		cancel()
 	}()
 
-loop:
+	write, err := startStream(w)
+	if err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
 	for {
+		var err error
 		select {
 		case <-r.Context().Done():
-			break loop
+			return
 		case message := <-connection.receive:
-			if err := message.SendServerEvent(w, r, client.Id == message.client.Id); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			err = write(func() error {
+				return message.SendServerEvent(w, r, chat, client.Id == message.client.Id)
+			})
+			if err == nil {
+				broadcastLatencyHistogram.Observe(time.Since(message.createdAt).Seconds())
+				chat.MessageDelivered(connection, message)
 			}
-			flusher.Flush()
+		case <-connection.done:
+			// The chat has ended or the client was kicked.
+			write(func() error { return writeServerEvent(w, r, "end", EndEventView()) })
+			return
+		case event := <-connection.events:
+			err = write(func() error { return writeServerEvent(w, r, event.name, event.data) })
+		case <-heartbeat.C:
+			err = write(func() error { return writeHeartbeat(w) })
+		}
+
+		if err != nil {
+			// The client is gone or does not keep up, drop the connection. It reconnects if it is still around.
+			deadConnectionsCounter.Inc()
+			slog.Debug("connection write failed", chatAttr(chat), clientAttr(client), slog.String("connection_id", connectionId), slog.Any("error", err))
+			return
 		}
 	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons a chat ended, used as label of the chats ended metric.
+const (
+	EndReasonFuse     string = "fuse"
+	EndReasonLifetime string = "lifetime"
+	EndReasonManual   string = "manual"
+	EndReasonAdmin    string = "admin"
+	EndReasonEvicted  string = "evicted"
+)
+
+var (
+	activeChatsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fusechat_active_chats",
+		Help: "Number of chats that have not ended yet.",
+	})
+	activeConnectionsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fusechat_active_connections",
+		Help: "Number of open server-sent event connections.",
+	})
+	messagesPostedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fusechat_messages_posted_total",
+		Help: "Number of messages posted to all chats.",
+	})
+	chatsEndedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fusechat_chats_ended_total",
+		Help: "Number of ended chats by reason: the fuse burned out, the lifetime was reached, the chat was ended manually or by an operator.",
+	}, []string{"reason"})
+	chatLifetimeHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fusechat_chat_lifetime_seconds",
+		Help:    "Age of chats when they ended.",
+		Buckets: prometheus.ExponentialBuckets(30, 2, 12),
+	})
+	broadcastLatencyHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fusechat_broadcast_latency_seconds",
+		Help:    "Time from posting a message until it was written to a connection.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+	droppedDeliveriesCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fusechat_dropped_deliveries_total",
+		Help: "Number of messages and events dropped because a connection did not keep up.",
+	})
+	deadConnectionsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fusechat_dead_connections_total",
+		Help: "Number of connections dropped because writing to them failed or timed out.",
+	})
+	httpRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fusechat_http_requests_total",
+		Help: "Number of HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "code"})
+	httpDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fusechat_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by method and route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+// MetricsMiddleware records the HTTP request metrics.
+// Requests are labeled with the chi route pattern (e.g. /c/{chatId}/) instead of the raw path,
+// so chat IDs do not blow up the metrics' cardinality.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := routePattern(r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		method := methodLabel(r.Method)
+		httpRequestsCounter.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+		httpDurationHistogram.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// methodLabel returns the request method, or "other" for methods not defined by HTTP,
+// so made-up methods do not blow up the metrics' cardinality either.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// routePattern returns the chi route pattern that matched the request, or "unmatched" if no route matched.
+func routePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.RoutePattern() == "" {
+		return "unmatched"
+	}
+	// Sub-routers with middlewares join their patterns with a double slash, e.g. /admin//.
+	return strings.ReplaceAll(rctx.RoutePattern(), "//", "/")
+}
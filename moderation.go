@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var (
+	ErrClientBanned = errors.New("You have been removed from this chat.")
+	ErrChatLocked   = errors.New("This chat is locked and only admits new participants with an invite link.")
+	ErrChatFull     = errors.New("This chat is full.")
+	ErrNotMember    = errors.New("You have not joined this chat.")
+)
+
+// pendingSeatTimeout is the time a seat taken with an invite is held for a client that has not connected yet.
+const pendingSeatTimeout time.Duration = time.Minute
+
+// participantOptions are the maximum numbers of participants a chat can be created with, if the server allows them.
+var participantOptions = []int{2, 5, 10}
+
+// ParticipantOptions returns the participant options allowed by the server's maximum.
+// The server's maximum itself is always the last option.
+func ParticipantOptions() []int {
+	options := make([]int, 0, len(participantOptions)+1)
+	for _, option := range participantOptions {
+		if option < config.MaxParticipants {
+			options = append(options, option)
+		}
+	}
+	return append(options, config.MaxParticipants)
+}
+
+// Admit checks whether the client may enter the chat, without taking a seat:
+// clients only become members once they connect to the chat's stream (see join) or use an invite (see AdmitInvite),
+// so link previews and crawlers do not fill the chat.
+// Returns ErrClientBanned if the client was kicked and ErrChatLocked if the chat is locked and the client is not a member yet.
+// Returns ErrChatFull if the chat already has its maximum number of members.
+// Locked chats only admit new members with an invite, see AdmitInvite.
+func (c *Chat) Admit(client *Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.banned[client.Id] {
+		return ErrClientBanned
+	}
+	if _, ok := c.members[client.Id]; ok {
+		// Pick up changes of the client's profile.
+		c.members[client.Id] = client
+		return nil
+	}
+	if c.locked {
+		return ErrChatLocked
+	}
+	if !c.hasSeat(time.Now()) {
+		return ErrChatFull
+	}
+	return nil
+}
+
+// join adds the client to the chat's members, unless it is a member already.
+// Returns the same errors as Admit. It must be called with the chat's lock held.
+func (c *Chat) join(client *Client) error {
+	if c.banned[client.Id] {
+		return ErrClientBanned
+	}
+	if _, ok := c.members[client.Id]; ok {
+		return nil
+	}
+	if c.locked {
+		return ErrChatLocked
+	}
+	if !c.hasSeat(time.Now()) {
+		return ErrChatFull
+	}
+
+	c.addMember(client)
+	slog.Info("client joined", chatAttr(c), clientAttr(client))
+	return nil
+}
+
+// hasSeat reports whether the chat has room for another member.
+// Seats of members that joined with an invite but never connected are freed first.
+// It must be called with the chat's lock held.
+func (c *Chat) hasSeat(now time.Time) bool {
+	c.freePendingSeats(now)
+	return len(c.members) < c.maxParticipants
+}
+
+// freePendingSeats removes the members that joined with an invite but did not connect within pendingSeatTimeout.
+// The owner keeps its seat even if it never connected, ownership may have been transferred to a pending member.
+// It must be called with the chat's lock held.
+func (c *Chat) freePendingSeats(now time.Time) {
+	for id, joined := range c.pending {
+		if id == c.owner.Id {
+			delete(c.pending, id)
+			continue
+		}
+		if now.Sub(joined) > pendingSeatTimeout {
+			slog.Info("seat freed", chatAttr(c), slog.String("client_id", id))
+			c.removeMember(id)
+		}
+	}
+}
+
+// IsMember reports whether the client is a member of the chat.
+func (c *Chat) IsMember(client *Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.members[client.Id]
+	return ok
+}
+
+// addMember adds the client to the chat's members and the registry's index of the client's chats.
+// Messages posted before the client joined do not count as unread.
+// It must be called with the chat's lock held.
+func (c *Chat) addMember(client *Client) {
+	c.members[client.Id] = client
+	c.read[client.Id] = c.posted
+	chats.AddMember(client.Id, c)
+	dashboards.notify(client.Id)
+}
+
+// removeMember removes the client with the given ID from the chat's members and the registry's index of the client's chats.
+// It must be called with the chat's lock held.
+func (c *Chat) removeMember(clientId string) {
+	delete(c.members, clientId)
+	delete(c.pending, clientId)
+	delete(c.read, clientId)
+	chats.RemoveMember(clientId, c)
+	dashboards.notify(clientId)
+}
+
+// MaxParticipants returns the largest number of members of the chat.
+func (c *Chat) MaxParticipants() int {
+	return c.maxParticipants
+}
+
+// IsOwner reports whether the given client owns the chat.
+func (c *Chat) IsOwner(client *Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.owner.Id == client.Id
+}
+
+// Locked reports whether the chat is locked to new members.
+func (c *Chat) Locked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.locked
+}
+
+// SetLocked locks or unlocks the chat to new members.
+func (c *Chat) SetLocked(locked bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.locked = locked
+}
+
+// Members returns the chat's members sorted by name.
+func (c *Chat) Members() []*Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members := make([]*Client, 0, len(c.members))
+	for _, member := range c.members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// Kick removes the client with the given ID from the chat, closes all of its connections and bans it from rejoining.
+// The owner can not be kicked.
+func (c *Chat) Kick(clientId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if clientId == c.owner.Id {
+		return
+	}
+
+	c.removeMember(clientId)
+	c.banned[clientId] = true
+	slog.Info("client kicked", chatAttr(c), slog.String("client_id", clientId))
+
+	for _, connection := range c.conns {
+		if connection.client.Id == clientId {
+			connection.close()
+		}
+	}
+}
+
+// TransferOwnership makes the member with the given ID the owner of the chat.
+// It reports whether the ownership was transferred.
+func (c *Chat) TransferOwnership(clientId string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	member, ok := c.members[clientId]
+	if !ok {
+		return false
+	}
+
+	c.owner = member
+	slog.Info("ownership transferred", chatAttr(c), clientAttr(member))
+	return true
+}
+
+// OwnerMiddleware only lets requests of the chat's owner through, everyone else gets a 403 status.
+// It must be used after the ChatMiddleware.
+func OwnerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chat := r.Context().Value(ContextChatKey).(*Chat)
+		client := r.Context().Value(ContextClientKey).(*Client)
+
+		if !chat.IsOwner(client) {
+			http.Error(w, "only the owner of the chat may do this", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ModerationHandler renders the owner's moderation controls.
+// If the client is not (or no longer) the owner, it responds with an empty 286 status to end htmx polling.
+func ModerationHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+	client := r.Context().Value(ContextClientKey).(*Client)
+
+	if !chat.IsOwner(client) {
+		w.WriteHeader(286)
+		return
+	}
+
+	renderModeration(w, r, chat)
+}
+
+// KickHandler kicks the client given in the "client" form value.
+func KickHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+
+	chat.Kick(r.FormValue("client"))
+	renderModeration(w, r, chat)
+}
+
+// LockHandler locks the chat if the "locked" form value is "true", otherwise it unlocks the chat.
+func LockHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+
+	chat.SetLocked(r.FormValue("locked") == "true")
+	renderModeration(w, r, chat)
+}
+
+// TransferHandler transfers the ownership to the client given in the "client" form value.
+// The former owner's moderation controls are removed.
+func TransferHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+
+	if !chat.TransferOwnership(r.FormValue("client")) {
+		http.Error(w, "client is not a member of the chat", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// EndHandler ends the chat immediately. All clients are sent to the end page by the end event.
+func EndHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.Context().Value(ContextChatKey).(*Chat)
+
+	chat.End(EndReasonManual)
+	w.Header().Set("HX-Redirect", "/end")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// renderDenied renders the view explaining why the client was not admitted with the given status.
+// The request context should hold the client, so the view's forms carry its CSRF token.
+// Message streams of a full chat get the full event instead, browsers do not show the responses of streams.
+func renderDenied(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	if errors.Is(reason, ErrChatFull) && r.Header.Get("Accept") == "text/event-stream" {
+		writeFullEvent(w, r)
+		return
+	}
+
+	view := ChatDeniedView(reason.Error())
+	if errors.Is(reason, ErrChatFull) {
+		view = ChatFullView()
+	}
+
+	w.WriteHeader(status)
+	if err := view.Render(r.Context(), w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// renderModeration renders the ModerationView of the chat.
+func renderModeration(w http.ResponseWriter, r *http.Request, chat *Chat) {
+	err := ModerationView(chat).Render(r.Context(), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
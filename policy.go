@@ -0,0 +1,130 @@
+package main
+
+import (
+	"time"
+)
+
+// FusePolicy decides how a chat's fuse reacts to new messages.
+// Policies get the current time passed in, so they can be driven by a fake clock.
+// A policy instance belongs to a single chat and is only called with the chat's lock held.
+type FusePolicy interface {
+	// Reset returns the fuse's new end time after the client sent a message at now.
+	// end is the fuse's current end time.
+	Reset(now, end time.Time, client *Client) time.Time
+}
+
+// FullResetPolicy resets the fuse to its full duration on every message.
+type FullResetPolicy struct {
+	Duration time.Duration
+}
+
+func (p *FullResetPolicy) Reset(now, end time.Time, client *Client) time.Time {
+	return now.Add(p.Duration)
+}
+
+// AdditivePolicy adds Step to the fuse on every message, while never exceeding Cap.
+type AdditivePolicy struct {
+	Step time.Duration
+	Cap  time.Duration
+}
+
+func (p *AdditivePolicy) Reset(now, end time.Time, client *Client) time.Time {
+	end = end.Add(p.Step)
+	if max := now.Add(p.Cap); end.After(max) {
+		return max
+	}
+	return end
+}
+
+// OtherClientPolicy resets the fuse to its full duration,
+// but only on messages from a different client than the last message.
+// A client talking to itself does not keep the chat alive.
+type OtherClientPolicy struct {
+	Duration time.Duration
+
+	lastClientId string
+}
+
+func (p *OtherClientPolicy) Reset(now, end time.Time, client *Client) time.Time {
+	if client.Id == p.lastClientId {
+		return end
+	}
+	p.lastClientId = client.Id
+	return now.Add(p.Duration)
+}
+
+// DecayPolicy resets the fuse on every message, but each reset is shorter than the last one.
+// The n-th reset sets the fuse to Duration * Factor^n, but never to less than Min.
+type DecayPolicy struct {
+	Duration time.Duration
+	Factor   float64
+	Min      time.Duration
+
+	next time.Duration
+}
+
+func (p *DecayPolicy) Reset(now, end time.Time, client *Client) time.Time {
+	if p.next == 0 {
+		p.next = p.Duration
+	}
+	p.next = time.Duration(float64(p.next) * p.Factor)
+	if p.next < p.Min {
+		p.next = p.Min
+	}
+	return now.Add(p.next)
+}
+
+// FixedPolicy never resets the fuse, the chat ends after a fixed countdown.
+type FixedPolicy struct{}
+
+func (p *FixedPolicy) Reset(now, end time.Time, client *Client) time.Time {
+	return end
+}
+
+// FusePolicyOption is a fuse policy that can be selected when creating a chat.
+type FusePolicyOption struct {
+	Name  string
+	Label string
+	// New creates the policy for a fuse with the given duration.
+	New func(d time.Duration) FusePolicy
+}
+
+// FusePolicyOptions lists the selectable fuse policies, the first one is the default.
+var FusePolicyOptions = []FusePolicyOption{
+	{
+		Name:  "reset",
+		Label: "Every message resets the fuse",
+		New:   func(d time.Duration) FusePolicy { return &FullResetPolicy{Duration: d} },
+	},
+	{
+		Name:  "additive",
+		Label: "Every message adds to the fuse",
+		New:   func(d time.Duration) FusePolicy { return &AdditivePolicy{Step: d / 4, Cap: 5 * d} },
+	},
+	{
+		Name:  "other",
+		Label: "Only replies reset the fuse",
+		New:   func(d time.Duration) FusePolicy { return &OtherClientPolicy{Duration: d} },
+	},
+	{
+		Name:  "decay",
+		Label: "Every reset is shorter",
+		New:   func(d time.Duration) FusePolicy { return &DecayPolicy{Duration: d, Factor: 0.8, Min: d / 6} },
+	},
+	{
+		Name:  "fixed",
+		Label: "Fixed countdown",
+		New:   func(d time.Duration) FusePolicy { return &FixedPolicy{} },
+	},
+}
+
+// NewFusePolicy creates the policy with the given name for a fuse with the given duration.
+// Unknown names fall back to the default policy.
+func NewFusePolicy(name string, d time.Duration) FusePolicy {
+	for _, option := range FusePolicyOptions {
+		if option.Name == name {
+			return option.New(d)
+		}
+	}
+	return FusePolicyOptions[0].New(d)
+}
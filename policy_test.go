@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// policyStart is the fake clock's start time the policies are driven with.
+var policyStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// policyStep is one message sent to a policy: the offset of the message from policyStart,
+// the sender and the remaining fuse time expected after the message.
+type policyStep struct {
+	at     time.Duration
+	client *Client
+	want   time.Duration
+}
+
+// runPolicy sends the messages to the policy, starting with a fuse ending at start, and checks the remaining fuse times.
+func runPolicy(t *testing.T, policy FusePolicy, start time.Duration, steps []policyStep) {
+	t.Helper()
+
+	end := policyStart.Add(start)
+	for i, step := range steps {
+		now := policyStart.Add(step.at)
+		end = policy.Reset(now, end, step.client)
+		if got := end.Sub(now); got != step.want {
+			t.Errorf("message %d at %s: remaining %s, want %s", i+1, step.at, got, step.want)
+		}
+	}
+}
+
+func TestFullResetPolicy(t *testing.T) {
+	ada := &Client{Id: "ada"}
+	runPolicy(t, &FullResetPolicy{Duration: time.Minute}, time.Minute, []policyStep{
+		{10 * time.Second, ada, time.Minute},
+		{50 * time.Second, ada, time.Minute},
+	})
+}
+
+func TestAdditivePolicy(t *testing.T) {
+	ada := &Client{Id: "ada"}
+	policy := NewFusePolicy("additive", time.Minute)
+	runPolicy(t, policy, time.Minute, []policyStep{
+		{0, ada, 75 * time.Second},
+		{0, ada, 90 * time.Second},
+		{30 * time.Second, ada, 75 * time.Second},
+	})
+
+	// The fuse never exceeds the cap of five times the duration.
+	steps := make([]policyStep, 0, 20)
+	for i := 1; i <= 20; i++ {
+		want := min(time.Minute+time.Duration(i)*15*time.Second, 5*time.Minute)
+		steps = append(steps, policyStep{0, ada, want})
+	}
+	runPolicy(t, NewFusePolicy("additive", time.Minute), time.Minute, steps)
+}
+
+func TestOtherClientPolicy(t *testing.T) {
+	ada, bob := &Client{Id: "ada"}, &Client{Id: "bob"}
+	runPolicy(t, &OtherClientPolicy{Duration: time.Minute}, time.Minute, []policyStep{
+		{10 * time.Second, ada, time.Minute},
+		// Messages of the same client do not reset the fuse.
+		{30 * time.Second, ada, 40 * time.Second},
+		{40 * time.Second, bob, time.Minute},
+		{50 * time.Second, ada, time.Minute},
+	})
+}
+
+func TestDecayPolicy(t *testing.T) {
+	ada := &Client{Id: "ada"}
+	policy := NewFusePolicy("decay", time.Minute)
+	runPolicy(t, policy, time.Minute, []policyStep{
+		{0, ada, 48 * time.Second},
+		{0, ada, 38400 * time.Millisecond},
+		{0, ada, 30720 * time.Millisecond},
+		{0, ada, 24576 * time.Millisecond},
+	})
+
+	// The fuse never decays below a sixth of the duration.
+	for i := 0; i < 20; i++ {
+		policy.Reset(policyStart, policyStart, ada)
+	}
+	runPolicy(t, policy, 0, []policyStep{{0, ada, 10 * time.Second}})
+}
+
+func TestFixedPolicy(t *testing.T) {
+	ada := &Client{Id: "ada"}
+	runPolicy(t, &FixedPolicy{}, time.Minute, []policyStep{
+		{10 * time.Second, ada, 50 * time.Second},
+		{50 * time.Second, ada, 10 * time.Second},
+	})
+}
+
+func TestNewFusePolicy(t *testing.T) {
+	for _, option := range FusePolicyOptions {
+		if NewFusePolicy(option.Name, time.Minute) == nil {
+			t.Errorf("NewFusePolicy(%q) returned nil", option.Name)
+		}
+	}
+	if _, ok := NewFusePolicy("unknown", time.Minute).(*FullResetPolicy); !ok {
+		t.Error("unknown policies do not fall back to the full reset policy")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNameLength is the maximum number of characters of a display name.
+const maxNameLength = 32
+
+// ProfileOption is a selectable color or avatar of the profile.
+type ProfileOption struct {
+	Name  string
+	Label string
+}
+
+var (
+	// ProfileColors are the colors a client can choose for its name, styled by the author-color-* CSS classes.
+	ProfileColors = []ProfileOption{
+		{"navy", "Navy"},
+		{"teal", "Teal"},
+		{"green", "Green"},
+		{"olive", "Olive"},
+		{"maroon", "Maroon"},
+		{"purple", "Purple"},
+	}
+
+	// ProfileAvatars are the avatars a client can choose, taken from the bundled icons.
+	ProfileAvatars = []ProfileOption{
+		{"users", "address_book_pad_users.png"},
+		{"hourglass", "application_hourglass-0.png"},
+		{"envelope", "envelope_closed-0.png"},
+		{"network", "network_normal_two_pcs-4.png"},
+		{"error", "msg_error-0.png"},
+	}
+)
+
+// findProfileOption returns the option with the given name and whether it exists.
+func findProfileOption(options []ProfileOption, name string) (ProfileOption, bool) {
+	for _, option := range options {
+		if option.Name == name {
+			return option, true
+		}
+	}
+	return ProfileOption{}, false
+}
+
+// ColorClass returns the CSS class of the client's name color, empty for the default color.
+// Colors are applied with classes, since the Content-Security-Policy does not allow inline styles.
+func (client *Client) ColorClass() string {
+	if _, ok := findProfileOption(ProfileColors, client.Color); !ok {
+		return ""
+	}
+	return "author-color-" + client.Color
+}
+
+// AvatarURL returns the URL of the client's avatar, empty if it has none.
+func (client *Client) AvatarURL() string {
+	avatar, ok := findProfileOption(ProfileAvatars, client.Avatar)
+	if !ok {
+		return ""
+	}
+	return asset(avatar.Label)
+}
+
+// validName normalizes the display name and reports whether it may be used:
+// it must not be empty, too long or contain control characters.
+func validName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+		return "", false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// localPath returns the path if it is a path on this server, otherwise the fallback.
+// It keeps the settings page and the login from redirecting to other sites.
+func localPath(path, fallback string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return fallback
+	}
+	return path
+}
+
+// SettingsHandler renders the SettingsView of the client's profile.
+// The "return" query value is the page the client returns to after saving.
+func SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := clientContext(w, r)
+	client := ctx.Value(ContextClientKey).(*Client)
+
+	err := SettingsView(client, localPath(r.URL.Query().Get("return"), "/"), "").Render(ctx, w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// SaveSettingsHandler saves the "name", "color" and "avatar" form values in the client cookie
+// and redirects to the "return" form value.
+// The new profile is used for messages posted from now on, chats the client is a member of pick it up on the next request.
+func SaveSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := clientContext(w, r)
+	client := ctx.Value(ContextClientKey).(*Client)
+	returnPath := localPath(r.FormValue("return"), "/")
+
+	// The name of logged in clients is the one of their identity.
+	name, ok := client.Name, true
+	if !client.Verified {
+		name, ok = validName(r.FormValue("name"))
+	}
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		err := SettingsView(client, returnPath, "Please choose a name with 1 to 32 characters.").Render(ctx, w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	client.Name = name
+	client.Color = ""
+	if _, ok := findProfileOption(ProfileColors, r.FormValue("color")); ok {
+		client.Color = r.FormValue("color")
+	}
+	client.Avatar = ""
+	if _, ok := findProfileOption(ProfileAvatars, r.FormValue("avatar")); ok {
+		client.Avatar = r.FormValue("avatar")
+	}
+
+	setClientCookie(w, client)
+	http.Redirect(w, r, returnPath, http.StatusSeeOther)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter limits the rate of events per key, e.g. per client ID or IP address.
+// Keys that have not been seen for a while are forgotten. It is safe for concurrent use.
+type RateLimiter struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*limiterEntry
+	lastGC   time.Time
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing limit events per second with the given burst.
+// A limit of 0 allows every event.
+func NewRateLimiter(limit float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		limit:    rate.Limit(limit),
+		burst:    burst,
+		limiters: make(map[string]*limiterEntry),
+		lastGC:   time.Now(),
+	}
+}
+
+// Allow reports whether an event for the given key may happen now.
+func (rl *RateLimiter) Allow(key string) bool {
+	if rl.limit == 0 {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastGC) > time.Minute {
+		for k, entry := range rl.limiters {
+			if now.Sub(entry.lastSeen) > 10*time.Minute {
+				delete(rl.limiters, k)
+			}
+		}
+		rl.lastGC = now
+	}
+
+	entry, ok := rl.limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.limiters[key] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.AllowN(now, 1)
+}
+
+// Limited reports whether the events for the given key are currently exhausted, without counting an event.
+func (rl *RateLimiter) Limited(key string) bool {
+	if rl.limit == 0 {
+		return false
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	entry, ok := rl.limiters[key]
+	return ok && entry.limiter.TokensAt(time.Now()) < 1
+}
+
+var (
+	// messageLimiter limits the messages posted per client.
+	messageLimiter = NewRateLimiter(0, 1)
+	// chatLimiter limits the chats created per IP address.
+	chatLimiter = NewRateLimiter(0, 1)
+	// lookupLimiter limits the failed chat lookups per IP address, so invite codes cannot be guessed.
+	lookupLimiter = NewRateLimiter(0, 1)
+)
+
+// setupRateLimits creates the rate limiters from the configuration.
+func setupRateLimits(c RateLimitConfig) {
+	messageLimiter = NewRateLimiter(c.Messages, c.MessageBurst)
+	// Chats are configured per minute, allow creating a few at once.
+	chatLimiter = NewRateLimiter(c.Chats/60, max(1, int(c.Chats)))
+	lookupLimiter = NewRateLimiter(c.Lookups/60, max(1, int(c.Lookups)))
+}
+
+// trustedProxies are the reverse proxies whose forwarding headers are trusted.
+var trustedProxies []netip.Prefix
+
+// setupTrustedProxies sets the reverse proxies whose forwarding headers are trusted from the configuration.
+func setupTrustedProxies(proxies []string) error {
+	prefixes, err := parsePrefixes(proxies)
+	if err != nil {
+		return err
+	}
+	trustedProxies = prefixes
+	return nil
+}
+
+// parsePrefixes parses IP addresses and CIDR ranges, a single address is a range of its own.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, item := range list {
+		if addr, err := netip.ParseAddr(item); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// isTrustedProxy reports whether the IP address belongs to a trusted proxy.
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the client that sent the request.
+// Behind trusted proxies it is the address right before the last trusted proxy in the X-Forwarded-For header,
+// or the X-Real-IP header. Otherwise it is the request's remote address, clients can set the headers themselves.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	// Every proxy appends the address it received the request from, so only the right end can be trusted.
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" || isTrustedProxy(ip) {
+			continue
+		}
+		if _, err := netip.ParseAddr(ip); err != nil {
+			return host
+		}
+		return ip
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		if _, err := netip.ParseAddr(ip); err == nil {
+			return ip
+		}
+	}
+	return host
+}
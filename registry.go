@@ -0,0 +1,181 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry keeps track of all live chats, their invite codes and their members. It is safe for concurrent use.
+type Registry struct {
+	mu      sync.RWMutex
+	chats   map[string]*Chat
+	codes   map[string]*Chat
+	invites map[string]*Chat
+	// members indexes the chats by their members: client ID to chat ID to chat.
+	members map[string]map[string]*Chat
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		chats:   make(map[string]*Chat),
+		codes:   make(map[string]*Chat),
+		invites: make(map[string]*Chat),
+		members: make(map[string]map[string]*Chat),
+	}
+}
+
+// Add adds the chat to the registry.
+// If invite codes are enabled, the chat is assigned a code that is not used by another live chat.
+func (reg *Registry) Add(c *Chat) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.chats[c.id] = c
+	if config.InviteCodes {
+		c.code = reg.uniqueCode()
+		reg.codes[c.code] = c
+	}
+}
+
+// uniqueCode returns an invite code that is not in use. Must be called with the lock held.
+func (reg *Registry) uniqueCode() string {
+	words := inviteCodeWords
+	for attempt := 0; ; attempt++ {
+		code := newInviteCode(words)
+		if _, taken := reg.codes[code]; !taken {
+			return code
+		}
+		// Many collisions mean the code space is getting crowded, make the codes longer.
+		if attempt%10 == 9 {
+			words++
+		}
+	}
+}
+
+// GetByCode returns the chat with the given invite code and whether it exists.
+// Codes are case-insensitive.
+func (reg *Registry) GetByCode(code string) (*Chat, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	c, ok := reg.codes[strings.ToLower(code)]
+	return c, ok
+}
+
+// Get returns the chat with the given ID and whether it exists.
+func (reg *Registry) Get(id string) (*Chat, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	c, ok := reg.chats[id]
+	return c, ok
+}
+
+// AddInvite registers the invite token of the chat.
+func (reg *Registry) AddInvite(token string, c *Chat) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.invites[token] = c
+}
+
+// RemoveInvite removes the invite token.
+func (reg *Registry) RemoveInvite(token string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	delete(reg.invites, token)
+}
+
+// GetByInvite returns the chat the invite token belongs to and whether it exists.
+func (reg *Registry) GetByInvite(token string) (*Chat, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	c, ok := reg.invites[token]
+	return c, ok
+}
+
+// AddMember records that the client is a member of the chat.
+func (reg *Registry) AddMember(clientId string, c *Chat) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if reg.members[clientId] == nil {
+		reg.members[clientId] = make(map[string]*Chat)
+	}
+	reg.members[clientId][c.id] = c
+}
+
+// RemoveMember records that the client is no longer a member of the chat.
+func (reg *Registry) RemoveMember(clientId string, c *Chat) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.removeMember(clientId, c.id)
+}
+
+// removeMember removes the chat from the client's chats. Must be called with the lock held.
+func (reg *Registry) removeMember(clientId string, chatId string) {
+	delete(reg.members[clientId], chatId)
+	if len(reg.members[clientId]) == 0 {
+		delete(reg.members, clientId)
+	}
+}
+
+// ListByMember returns the chats the client is a member of, oldest first.
+func (reg *Registry) ListByMember(clientId string) []*Chat {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	list := make([]*Chat, 0, len(reg.members[clientId]))
+	for _, c := range reg.members[clientId] {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].createTime.Before(list[j].createTime) })
+	return list
+}
+
+// Remove removes the chat with the given ID, its invite tokens and its members from the registry.
+func (reg *Registry) Remove(id string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if c, ok := reg.chats[id]; ok && c.code != "" {
+		delete(reg.codes, c.code)
+	}
+	for token, c := range reg.invites {
+		if c.id == id {
+			delete(reg.invites, token)
+		}
+	}
+	for clientId, chats := range reg.members {
+		if _, ok := chats[id]; ok {
+			reg.removeMember(clientId, id)
+		}
+	}
+	delete(reg.chats, id)
+}
+
+// List returns all chats, oldest first.
+func (reg *Registry) List() []*Chat {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	list := make([]*Chat, 0, len(reg.chats))
+	for _, c := range reg.chats {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].createTime.Before(list[j].createTime) })
+	return list
+}
+
+// Len returns the number of chats in the registry.
+func (reg *Registry) Len() int {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	return len(reg.chats)
+}
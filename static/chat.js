@@ -0,0 +1,27 @@
+// Behaviour of the chat view, kept out of the templates so no inline scripts are needed
+// and the Content-Security-Policy can forbid them.
+(function () {
+  // Selects the whole invite URL with a single click.
+  document.addEventListener("click", function (event) {
+    if (event.target.matches("[data-select-on-click]")) {
+      event.target.select();
+    }
+  });
+
+  // Keeps the newest message in view.
+  // Workaround for scrolling after SSE swaps: https://github.com/bigskysoftware/htmx/issues/784
+  document.addEventListener("htmx:afterSettle", function (event) {
+    var elt = event.target;
+    if (elt.matches && elt.matches("[data-scroll-bottom]")) {
+      elt.scrollTo(0, elt.scrollHeight);
+    }
+  });
+
+  // Clears the message form after it was sent.
+  document.addEventListener("htmx:afterRequest", function (event) {
+    var elt = event.target;
+    if (elt.matches && elt.matches("form[data-reset-after-request]")) {
+      elt.reset();
+    }
+  });
+})();
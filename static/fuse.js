@@ -0,0 +1,55 @@
+// Turns the warning events of the fuse into something hard to miss:
+// a flashing status bar, a short beep and a notification if the tab is in the background.
+(function () {
+  var flashTimeout;
+
+  function beep() {
+    var AudioContext = window.AudioContext || window.webkitAudioContext;
+    if (!AudioContext) return;
+
+    var ctx = new AudioContext();
+    var oscillator = ctx.createOscillator();
+    var gain = ctx.createGain();
+    oscillator.type = "square";
+    oscillator.frequency.value = 880;
+    gain.gain.value = 0.05;
+    oscillator.connect(gain);
+    gain.connect(ctx.destination);
+    oscillator.start();
+    oscillator.stop(ctx.currentTime + 0.2);
+    oscillator.onended = function () {
+      ctx.close();
+    };
+  }
+
+  function flash() {
+    document.body.classList.add("fuse-warning");
+    clearTimeout(flashTimeout);
+    flashTimeout = setTimeout(function () {
+      document.body.classList.remove("fuse-warning");
+    }, 5000);
+  }
+
+  function notify(text) {
+    if (!document.hidden || !("Notification" in window)) return;
+    if (Notification.permission === "granted") {
+      new Notification(document.title, { body: text, tag: "fuse-warning" });
+    }
+  }
+
+  document.addEventListener("htmx:sseMessage", function (event) {
+    if (!event.detail || event.detail.type !== "warning") return;
+
+    var text = event.detail.data.trim();
+    flash();
+    beep();
+    notify(text);
+  });
+
+  // Notifications may only be requested in response to a user action, so ask when the first message is sent.
+  document.addEventListener("submit", function () {
+    if ("Notification" in window && Notification.permission === "default") {
+      Notification.requestPermission();
+    }
+  });
+})();
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newTLSConfig creates the TLS configuration for the configured certificate source.
+// The returned handler answers plain HTTP requests: ACME HTTP-01 challenges (if ACME is enabled)
+// and redirects to HTTPS for everything else.
+func newTLSConfig(c TLSConfig) (*tls.Config, http.Handler, error) {
+	var redirect http.Handler = http.HandlerFunc(RedirectHTTPSHandler)
+
+	switch {
+	case c.Cert != "":
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, redirect, nil
+
+	case len(c.ACME.Domains) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(c.ACME.CacheDir),
+			HostPolicy: autocert.HostWhitelist(c.ACME.Domains...),
+			Email:      c.ACME.Email,
+		}
+		if c.ACME.DirectoryURL != "" {
+			manager.Client = &acme.Client{DirectoryURL: c.ACME.DirectoryURL}
+		}
+		return manager.TLSConfig(), manager.HTTPHandler(redirect), nil
+
+	case c.SelfSigned:
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, redirect, nil
+	}
+
+	return nil, nil, fmt.Errorf("TLS is not configured")
+}
+
+// selfSignedCertificate generates a certificate for localhost that is valid for a year.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"fuse-chat self-signed"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if u, err := url.Parse(config.BaseURL); err == nil && u.Hostname() != "localhost" {
+		template.DNSNames = append(template.DNSNames, u.Hostname())
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// RedirectHTTPSHandler redirects plain HTTP requests to the same path on the public HTTPS base URL.
+func RedirectHTTPSHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, config.BaseURL+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// HSTSMiddleware tells browsers to only use HTTPS for the configured time.
+// The header is only sent on HTTPS responses, as browsers ignore it on plain HTTP,
+// and not with a self-signed certificate, which is meant for local testing.
+func HSTSMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && config.TLS.HSTS > 0 && !config.TLS.SelfSigned {
+			w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int(config.TLS.HSTS.Seconds())))
+		}
+		next.ServeHTTP(w, r)
+	})
+}